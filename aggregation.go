@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amir/raidman"
+)
+
+var defaultAggregationFunctions = []string{"min", "max", "mean", "count"}
+
+// Aggregation configures the local aggregation of the events of a driver:
+// the metrics of every service are collected for Window seconds and only
+// the summaries (one event per function, with the function name appended
+// to the service and as a tag) are sent by the first run after the end of
+// the window. Functions are min, max, mean, sum, count and percentiles (p50, p99...).
+type Aggregation struct {
+	Window    int
+	Functions []string
+	// glob patterns of the aggregated services (all of them if empty)
+	Services []string
+}
+
+func (a *Aggregation) Enabled() bool {
+	return a.Window > 0
+}
+
+func (a *Aggregation) Validate() error {
+	if a.Window < 0 {
+		return fmt.Errorf("bad aggregation window: %v", a.Window)
+	}
+
+	if !a.Enabled() {
+		return nil
+	}
+
+	if len(a.Functions) == 0 {
+		a.Functions = defaultAggregationFunctions
+	}
+
+	for _, fn := range a.Functions {
+		if _, err := aggregate(fn, []float64{0}); err != nil {
+			return err
+		}
+	}
+
+	for _, pattern := range a.Services {
+		if _, err := CompileGlob(pattern); err != nil {
+			return fmt.Errorf("bad aggregation pattern: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func (a *Aggregation) isAggregated(service string) bool {
+	if len(a.Services) == 0 {
+		return true
+	}
+	for _, pattern := range a.Services {
+		if matchGlob(pattern, service) {
+			return true
+		}
+	}
+	return false
+}
+
+// aggregate applies the function to the (non empty) values
+func aggregate(fn string, values []float64) (float64, error) {
+	switch fn {
+	case "count":
+		return float64(len(values)), nil
+	case "sum", "mean":
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+		}
+		if fn == "mean" {
+			return sum / float64(len(values)), nil
+		}
+		return sum, nil
+	case "min":
+		res := math.Inf(1)
+		for _, v := range values {
+			res = math.Min(res, v)
+		}
+		return res, nil
+	case "max":
+		res := math.Inf(-1)
+		for _, v := range values {
+			res = math.Max(res, v)
+		}
+		return res, nil
+	}
+
+	if strings.HasPrefix(fn, "p") {
+		p, err := strconv.ParseFloat(fn[1:], 64)
+		if err == nil && p > 0 && p <= 100 {
+			return percentile(values, p), nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown aggregation function: %s", fn)
+}
+
+// percentile returns the p-th percentile of the values (nearest rank)
+func percentile(values []float64, p float64) float64 {
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+type aggregatedSeries struct {
+	last   raidman.Event
+	values []float64
+}
+
+// aggregationWindow collects the metrics of the current window, by host
+// and service
+type aggregationWindow struct {
+	sync.Mutex
+	start  time.Time
+	series map[[2]string]*aggregatedSeries
+	// keys in arrival order, so that summaries are sent in a stable order
+	keys [][2]string
+}
+
+func newAggregationWindow() *aggregationWindow {
+	return &aggregationWindow{series: map[[2]string]*aggregatedSeries{}}
+}
+
+// Add collects the event if it must be aggregated; it returns false if
+// the event has been consumed
+func (a *Aggregation) Add(window *aggregationWindow, ev *raidman.Event, now time.Time) bool {
+	if !a.Enabled() || !a.isAggregated(ev.Service) {
+		return true
+	}
+
+	value, ok := metricValue(ev)
+	if !ok {
+		return true
+	}
+
+	window.Lock()
+	defer window.Unlock()
+
+	if window.start.IsZero() {
+		window.start = now
+	}
+
+	key := [2]string{ev.Host, ev.Service}
+	s, found := window.series[key]
+	if !found {
+		s = &aggregatedSeries{}
+		window.series[key] = s
+		window.keys = append(window.keys, key)
+	}
+	s.last = *ev
+	s.values = append(s.values, value)
+
+	return false
+}
+
+// Flush returns the summary events if the window is over, starting a new one.
+// Windows are closed by the driver runs, so a summary must live for the
+// window plus one interval, until the next summary replaces it.
+func (a *Aggregation) Flush(window *aggregationWindow, now time.Time, interval time.Duration) []*raidman.Event {
+	if !a.Enabled() {
+		return nil
+	}
+
+	window.Lock()
+	defer window.Unlock()
+
+	if window.start.IsZero() || now.Sub(window.start) < time.Duration(a.Window)*time.Second {
+		return nil
+	}
+
+	ttl := float32((time.Duration(a.Window)*time.Second + interval).Seconds())
+
+	res := []*raidman.Event{}
+	for _, key := range window.keys {
+		s := window.series[key]
+		for _, fn := range a.Functions {
+			value, err := aggregate(fn, s.values)
+			if err != nil {
+				continue
+			}
+
+			ev := s.last
+			ev.Service = s.last.Service + " " + fn
+			ev.Metric = value
+			ev.Time = now.Unix()
+			if ev.Ttl < ttl {
+				ev.Ttl = ttl
+			}
+			ev.Tags = mergeTags(s.last.Tags, []string{fn})
+			ev.Attributes = mergeAttributes(s.last.Attributes, map[string]string{"aggregation": fn})
+			res = append(res, &ev)
+		}
+	}
+
+	window.start = time.Time{}
+	window.series = map[[2]string]*aggregatedSeries{}
+	window.keys = nil
+
+	return res
+}
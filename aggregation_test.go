@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/amir/raidman"
+)
+
+func TestAggregate(m *testing.T) {
+	values := []float64{4, 1, 3, 2, 10}
+
+	expected := map[string]float64{
+		"min": 1, "max": 10, "sum": 20, "mean": 4, "count": 5,
+		"p50": 3, "p90": 10, "p20": 1, "p100": 10,
+	}
+
+	for fn, value := range expected {
+		res, err := aggregate(fn, values)
+		if err != nil {
+			m.Errorf("%s: %v", fn, err)
+		}
+		AssertEqual(m, res, value)
+	}
+
+	for _, fn := range []string{"avg", "p0", "p101", "px"} {
+		if _, err := aggregate(fn, values); err == nil {
+			m.Errorf("error expected for %s", fn)
+		}
+	}
+}
+
+func TestAggregationWindow(m *testing.T) {
+	a := Aggregation{Window: 60, Functions: []string{"max", "count"}, Services: []string{"cpu*"}}
+	if err := a.Validate(); err != nil {
+		m.Fatal(err)
+	}
+
+	window := newAggregationWindow()
+	now := time.Now()
+
+	for i, value := range []float64{1, 5, 3} {
+		ev := raidman.Event{Host: "h", Service: "cpu", Metric: value, Tags: []string{"t"}, Ttl: 20}
+		AssertEqual(m, a.Add(window, &ev, now.Add(time.Duration(i*10)*time.Second)), false)
+	}
+
+	// not aggregated
+	ev := raidman.Event{Host: "h", Service: "load", Metric: 1.0}
+	AssertEqual(m, a.Add(window, &ev, now), true)
+
+	AssertEqual(m, len(a.Flush(window, now.Add(30*time.Second), 10*time.Second)), 0)
+
+	summaries := a.Flush(window, now.Add(60*time.Second), 10*time.Second)
+	if len(summaries) != 2 {
+		m.Fatalf("2 summaries expected, %d found", len(summaries))
+	}
+
+	AssertEqual(m, summaries[0].Service, "cpu max")
+	AssertEqual(m, summaries[0].Metric, 5.0)
+	AssertEqual(m, summaries[0].Tags[1], "max")
+	AssertEqual(m, summaries[0].Attributes["aggregation"], "max")
+	// alive until the next summary, not only for the ttl of the last event
+	AssertEqual(m, summaries[0].Ttl, float32(70))
+	AssertEqual(m, summaries[1].Service, "cpu count")
+	AssertEqual(m, summaries[1].Metric, 3.0)
+
+	// new window
+	AssertEqual(m, len(a.Flush(window, now.Add(200*time.Second), 10*time.Second)), 0)
+}
+
+func TestAggregationValidation(m *testing.T) {
+	bad := []Aggregation{
+		{Window: -1},
+		{Window: 10, Functions: []string{"median"}},
+		{Window: 10, Services: []string{"[a"}},
+	}
+
+	for _, a := range bad {
+		if a.Validate() == nil {
+			m.Errorf("error expected for %+v", a)
+		}
+	}
+
+	a := Aggregation{Window: 10}
+	a.Validate()
+	AssertEqual(m, len(a.Functions), len(defaultAggregationFunctions))
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/amir/raidman"
+)
+
+// AlertRule is a local alert: after Count consecutive events of the same
+// service matching Service and State (regular expressions), Command is
+// executed and/or the event is posted to Webhook, then the rule is muted
+// for Cooldown seconds. This works even when riemann is unreachable.
+type AlertRule struct {
+	Name     string
+	Service  string
+	State    string
+	Count    int
+	Command  []string
+	Webhook  string
+	Cooldown int
+	Timeout  int
+
+	match *eventMatcher
+}
+
+func (r *AlertRule) Validate() error {
+	if len(r.Command) == 0 && r.Webhook == "" {
+		return fmt.Errorf("alert %s: command or webhook required", r.Name)
+	}
+
+	if r.Count < 0 || r.Cooldown < 0 || r.Timeout < 0 {
+		return fmt.Errorf("alert %s: count, cooldown and timeout must be positive", r.Name)
+	}
+
+	if r.Count == 0 {
+		r.Count = 1
+	}
+
+	if r.Timeout == 0 {
+		r.Timeout = 10
+	}
+
+	var err error
+	r.match, err = newEventMatcher(r.Service, r.State)
+	if err != nil {
+		return fmt.Errorf("alert %s: %v", r.Name, err)
+	}
+
+	return nil
+}
+
+// alertPayload is the event data passed to the alert actions
+type alertPayload struct {
+	Rule        string            `json:"rule"`
+	Host        string            `json:"host"`
+	Service     string            `json:"service"`
+	State       string            `json:"state"`
+	Metric      interface{}       `json:"metric"`
+	Description string            `json:"description"`
+	Tags        []string          `json:"tags"`
+	Attributes  map[string]string `json:"attributes"`
+	Time        int64             `json:"time"`
+}
+
+// Alerter checks the events produced by the drivers against the alert rules
+type Alerter struct {
+	sync.Mutex
+	rules []*AlertRule
+	// consecutive matches, by rule, host and service
+	matches map[[3]string]int
+	// time of the last alert, by rule
+	fired map[string]time.Time
+	// runs the actions (replaced in tests)
+	run func(rule *AlertRule, payload []byte)
+}
+
+func NewAlerter(rules []AlertRule) *Alerter {
+	a := &Alerter{matches: map[[3]string]int{}, fired: map[string]time.Time{}, run: runAlertActions}
+	a.SetRules(rules)
+	return a
+}
+
+// SetRules replaces the alert rules; the cooldowns of the rules still
+// present are kept
+func (a *Alerter) SetRules(rules []AlertRule) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.rules = nil
+	present := map[string]bool{}
+	for i := range rules {
+		a.rules = append(a.rules, &rules[i])
+		present[rules[i].Name] = true
+	}
+
+	a.matches = map[[3]string]int{}
+	for name := range a.fired {
+		if !present[name] {
+			delete(a.fired, name)
+		}
+	}
+}
+
+// Check updates the rules with the given event, firing the ones due
+func (a *Alerter) Check(ev *raidman.Event) {
+	if a == nil {
+		return
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	if len(a.rules) == 0 {
+		return
+	}
+
+	now := time.Now()
+
+	for _, rule := range a.rules {
+		key := [3]string{rule.Name, ev.Host, ev.Service}
+
+		if !rule.match.Match(ev) {
+			delete(a.matches, key)
+			continue
+		}
+
+		a.matches[key]++
+		if a.matches[key] < rule.Count {
+			continue
+		}
+		a.matches[key] = 0
+
+		last, found := a.fired[rule.Name]
+		if found && now.Sub(last) < time.Duration(rule.Cooldown)*time.Second {
+			log.Debug("Alert %s on %s muted (cooldown)", rule.Name, ev.Service)
+			continue
+		}
+		a.fired[rule.Name] = now
+
+		payload, err := json.Marshal(alertPayload{rule.Name, ev.Host, ev.Service, ev.State, ev.Metric,
+			ev.Description, ev.Tags, ev.Attributes, ev.Time})
+		if err != nil {
+			log.Error("Can't encode alert %s: %v", rule.Name, err)
+			continue
+		}
+
+		log.Notice("Alert %s fired by %s on %s (%s)", rule.Name, ev.Service, ev.Host, ev.State)
+		go a.run(rule, payload)
+	}
+}
+
+// runAlertActions executes the command (with the payload on stdin) and
+// posts the payload to the webhook
+func runAlertActions(rule *AlertRule, payload []byte) {
+	timeout := time.Duration(rule.Timeout) * time.Second
+
+	if len(rule.Command) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		cmd := exec.CommandContext(ctx, rule.Command[0], rule.Command[1:]...)
+		cmd.Stdin = bytes.NewReader(payload)
+		cmd.Env = append(os.Environ(), "RIEMANN_AGENT_ALERT="+rule.Name)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			log.Error("Alert %s: command failed: %v (%s)", rule.Name, err, bytes.TrimSpace(out))
+		}
+	}
+
+	if rule.Webhook != "" {
+		client := &http.Client{Timeout: timeout}
+		res, err := client.Post(rule.Webhook, "application/json", bytes.NewReader(payload))
+		if err != nil {
+			log.Error("Alert %s: webhook failed: %v", rule.Name, err)
+		} else {
+			res.Body.Close()
+			if res.StatusCode >= 300 {
+				log.Error("Alert %s: webhook failed: %s", rule.Name, res.Status)
+			}
+		}
+	}
+}
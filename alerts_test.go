@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/amir/raidman"
+
+	"github.com/avalente/riemann-agent/modules"
+)
+
+func newTestAlerter(m *testing.T, rules []AlertRule) (*Alerter, chan map[string]interface{}) {
+	for i := range rules {
+		if err := rules[i].Validate(); err != nil {
+			m.Fatal(err)
+		}
+	}
+
+	fired := make(chan map[string]interface{}, 10)
+	a := NewAlerter(rules)
+	a.run = func(rule *AlertRule, payload []byte) {
+		data := map[string]interface{}{}
+		json.Unmarshal(payload, &data)
+		fired <- data
+	}
+
+	return a, fired
+}
+
+func TestAlerterConsecutiveMatches(m *testing.T) {
+	a, fired := newTestAlerter(m, []AlertRule{
+		{Name: "disk", Service: "^disk", State: "critical", Count: 2, Webhook: "http://localhost/hook", Cooldown: 3600},
+	})
+
+	a.Check(&raidman.Event{Service: "disk /", State: "critical"})
+	a.Check(&raidman.Event{Service: "disk /", State: "ok"})
+	a.Check(&raidman.Event{Service: "disk /", State: "critical"})
+	AssertEqual(m, len(fired), 0)
+
+	a.Check(&raidman.Event{Service: "disk /", State: "critical", Metric: 99.0})
+	data := <-fired
+	AssertEqual(m, data["rule"], "disk")
+	AssertEqual(m, data["service"], "disk /")
+	AssertEqual(m, data["metric"], 99.0)
+
+	// cooldown
+	a.Check(&raidman.Event{Service: "disk /", State: "critical"})
+	a.Check(&raidman.Event{Service: "disk /", State: "critical"})
+	AssertEqual(m, len(fired), 0)
+}
+
+func TestAlerterNoRules(m *testing.T) {
+	var a *Alerter
+	a.Check(&raidman.Event{})
+
+	NewAlerter(nil).Check(&raidman.Event{})
+}
+
+func TestGetConfigurationAlerts(m *testing.T) {
+	file := createCFExt(ctx, ".yaml", "alerts:\n  - service: load\n    command: [/bin/true]\n")
+	cfg, err := GetConfiguration(file)
+
+	if err != nil {
+		m.Fatalf("No errors expected, found %s", err.Error())
+	}
+
+	AssertEqual(m, cfg.Alerts[0].Name, "alert-1")
+	AssertEqual(m, cfg.Alerts[0].Count, 1)
+
+	file = createCFExt(ctx, ".yaml", "alerts:\n  - service: load\n  - service: '('\n    webhook: http://localhost\n")
+	cfg, err = GetConfiguration(file)
+
+	checkNoResults(m, cfg)
+	checkError(m, err, ":2: alert alert-1: command or webhook required")
+}
+
+func TestAlerterSetRules(m *testing.T) {
+	a, fired := newTestAlerter(m, []AlertRule{
+		{Name: "disk", Service: "^disk", State: "critical", Webhook: "http://localhost/hook"},
+	})
+
+	rules := []AlertRule{{Name: "load", Service: "^load", State: "critical", Webhook: "http://localhost/hook"}}
+	for i := range rules {
+		if err := rules[i].Validate(); err != nil {
+			m.Fatal(err)
+		}
+	}
+	a.SetRules(rules)
+
+	a.Check(&raidman.Event{Service: "disk /", State: "critical"})
+	AssertEqual(m, len(fired), 0)
+
+	a.Check(&raidman.Event{Service: "load", State: "critical"})
+	data := <-fired
+	AssertEqual(m, data["rule"], "load")
+}
+
+func TestAlertsWithFullQueue(m *testing.T) {
+	a, fired := newTestAlerter(m, []AlertRule{
+		{Name: "disk", Service: "^disk", State: "critical", Count: 3, Webhook: "http://localhost/hook"},
+	})
+
+	drv := schedulerDriver("disk", 10, func(params modules.ModuleParamList) modules.EventList {
+		return modules.EventList{&raidman.Event{State: "critical", Metric: 1}}
+	})
+	// the steady state is suppressed after the first event
+	drv.OnChange = OnChange{Enabled: true, Heartbeat: 3600}
+	drv.changeTracker = newChangeTracker()
+	drv.alerter = a
+	if err := drv.Start(); err != nil {
+		m.Fatal(err)
+	}
+	defer drv.Stop()
+
+	// no sender: the queue is always full
+	queue := make(ResQueue)
+
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 3; i++ {
+			if err := drv.Run(queue); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			m.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		m.Fatal("the driver blocked on the full queue")
+	}
+
+	select {
+	case data := <-fired:
+		AssertEqual(m, data["rule"], "disk")
+	case <-time.After(time.Second):
+		m.Fatal("alert expected")
+	}
+}
@@ -0,0 +1,282 @@
+package cfgfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	JSON = "json"
+	YAML = "yaml"
+	TOML = "toml"
+)
+
+var formats = map[string]string{
+	".json": JSON,
+	".yaml": YAML,
+	".yml":  YAML,
+	".toml": TOML,
+}
+
+// Extensions returns the file extensions recognized as configuration files
+func Extensions() []string {
+	return []string{".json", ".yaml", ".yml", ".toml"}
+}
+
+// Format returns the format of the given file based on its extension, or
+// an empty string if the extension is unknown
+func Format(fileName string) string {
+	return formats[strings.ToLower(filepath.Ext(fileName))]
+}
+
+// IsConfigFile returns true if the file has a supported extension
+func IsConfigFile(fileName string) bool {
+	return Format(fileName) != ""
+}
+
+// FileError is an error bound to a position in a configuration file
+type FileError struct {
+	File string
+	Line int
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d: %v", e.File, e.Line, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", e.File, e.Err)
+}
+
+// Document is a parsed configuration file, not yet bound to a structure
+type Document struct {
+	File   string
+	Format string
+	Data   []byte
+	Tree   interface{}
+	// paths of the values made of a single reference (see Interpolate)
+	references map[string]bool
+}
+
+// Read parses the given file according to its extension; files with
+// unknown extensions are parsed as JSON
+func Read(fileName string) (*Document, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	format := Format(fileName)
+	if format == "" {
+		format = JSON
+	}
+
+	return Parse(fileName, format, data)
+}
+
+// Parse parses data in the given format; fileName is only used in the
+// error messages
+func Parse(fileName string, format string, data []byte) (*Document, error) {
+	var err error
+
+	doc := &Document{File: fileName, Format: format, Data: data}
+
+	switch format {
+	case YAML:
+		err = yaml.Unmarshal(data, &doc.Tree)
+	case TOML:
+		tree := map[string]interface{}{}
+		_, err = toml.Decode(string(data), &tree)
+		doc.Tree = tree
+	default:
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		err = decoder.Decode(&doc.Tree)
+	}
+
+	if err != nil {
+		return nil, doc.syntaxError(err)
+	}
+
+	return doc, nil
+}
+
+// Decode binds the document to target (using the same case-insensitive
+// field matching as encoding/json), so that default values already set
+// in target are kept for the missing fields
+func (doc *Document) Decode(target interface{}) error {
+	return doc.decode(target, false)
+}
+
+// DecodeStrict is like Decode, but the keys not matching any field of
+// target are errors
+func (doc *Document) DecodeStrict(target interface{}) error {
+	return doc.decode(target, true)
+}
+
+func (doc *Document) decode(target interface{}, strict bool) error {
+	tree := doc.Tree
+	if len(doc.references) > 0 {
+		tree = doc.convertReferences(tree, reflect.TypeOf(target), []string{})
+	}
+
+	data, err := json.Marshal(tree)
+	if err != nil {
+		return &FileError{File: doc.File, Err: err}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if strict {
+		decoder.DisallowUnknownFields()
+	}
+	err = decoder.Decode(target)
+	if err != nil {
+		var typeError *json.UnmarshalTypeError
+		if errors.As(err, &typeError) && typeError.Field != "" {
+			path := strings.Split(typeError.Field, ".")
+			return &FileError{
+				File: doc.File,
+				Line: doc.Locate(path...),
+				Err:  fmt.Errorf("bad value for %s: %s not %v", typeError.Field, typeError.Value, typeError.Type),
+			}
+		}
+		if m := unknownField.FindStringSubmatch(err.Error()); m != nil {
+			return doc.Errorf([]string{m[1]}, "unknown key %s", m[1])
+		}
+		return &FileError{File: doc.File, Err: err}
+	}
+
+	return nil
+}
+
+// Errorf returns an error referring to the given key path in the document
+func (doc *Document) Errorf(path []string, format string, args ...interface{}) error {
+	return &FileError{File: doc.File, Line: doc.Locate(path...), Err: fmt.Errorf(format, args...)}
+}
+
+// Locate returns the line where the given key path is defined, or 0 if it
+// can't be found. Keys are compared case-insensitively.
+func (doc *Document) Locate(path ...string) int {
+	if len(path) == 0 {
+		return 0
+	}
+
+	if doc.Format == YAML {
+		var root yaml.Node
+		if yaml.Unmarshal(doc.Data, &root) != nil {
+			return 0
+		}
+		return locateYaml(&root, path)
+	}
+
+	// best effort: look for the innermost key name
+	key := ""
+	for i := len(path) - 1; i >= 0 && key == ""; i-- {
+		if _, err := strconv.Atoi(path[i]); err != nil {
+			key = regexp.QuoteMeta(path[i])
+		}
+	}
+	if key == "" {
+		return 0
+	}
+
+	if doc.Format == TOML {
+		return lineOfMatch(doc.Data, regexp.MustCompile(`(?im)^\s*["']?`+key+`["']?\s*=`))
+	}
+	return lineOfMatch(doc.Data, regexp.MustCompile(`(?i)"`+key+`"\s*:`))
+}
+
+func locateYaml(node *yaml.Node, path []string) int {
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		return locateYaml(node.Content[0], path)
+	}
+
+	if node.Kind == yaml.SequenceNode {
+		i, err := strconv.Atoi(path[0])
+		if err != nil || i < 0 || i >= len(node.Content) {
+			return 0
+		}
+		if len(path) == 1 {
+			return node.Content[i].Line
+		}
+		if line := locateYaml(node.Content[i], path[1:]); line > 0 {
+			return line
+		}
+		return node.Content[i].Line
+	}
+
+	if node.Kind != yaml.MappingNode {
+		return 0
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i]
+		if strings.EqualFold(key.Value, path[0]) {
+			if len(path) == 1 {
+				return key.Line
+			}
+			if line := locateYaml(node.Content[i+1], path[1:]); line > 0 {
+				return line
+			}
+			return key.Line
+		}
+	}
+
+	return 0
+}
+
+func lineOfMatch(data []byte, re *regexp.Regexp) int {
+	loc := re.FindIndex(data)
+	if loc == nil {
+		return 0
+	}
+	return lineOfOffset(data, int64(loc[1]))
+}
+
+func lineOfOffset(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+var yamlLine = regexp.MustCompile(`^yaml: line (\d+): `)
+
+var unknownField = regexp.MustCompile(`^json: unknown field "(.*)"$`)
+
+func (doc *Document) syntaxError(err error) error {
+	line := 0
+
+	var jsonSyntax *json.SyntaxError
+	var tomlParse toml.ParseError
+
+	switch {
+	case errors.As(err, &jsonSyntax):
+		line = lineOfOffset(doc.Data, jsonSyntax.Offset)
+	case err == io.ErrUnexpectedEOF:
+		line = lineOfOffset(doc.Data, int64(len(doc.Data)))
+	case errors.As(err, &tomlParse):
+		line = tomlParse.Position.Line
+		err = errors.New(tomlParse.Message)
+	case doc.Format == YAML:
+		// yaml errors embed the line number in the message
+		if m := yamlLine.FindStringSubmatch(err.Error()); m != nil {
+			line, _ = strconv.Atoi(m[1])
+			err = errors.New(err.Error()[len(m[0]):])
+		}
+	}
+
+	return &FileError{File: doc.File, Line: line, Err: err}
+}
@@ -0,0 +1,204 @@
+package cfgfile
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// matches "$${" (an escaped "${") or a "${...}" reference
+var reference = regexp.MustCompile(`\$\$\{|\$\{([^}]*)\}`)
+
+// matches a value made of a single environment variable reference
+var scalarReference = regexp.MustCompile(`^\$\{[^}]*\}$`)
+
+// Interpolate replaces the references found in every string value of the
+// document:
+//
+//	${VAR}              value of the environment variable VAR (must be set)
+//	${VAR:-default}     value of VAR, or default if VAR is unset or empty
+//	${file:/path}       content of the file, without the trailing newline
+//	$${                 a literal "${"
+//
+// Relative file paths are resolved from the directory of the document.
+// Values stay strings, but a value made of a single environment variable
+// reference can fill a numeric or boolean field when decoded (see Decode).
+// Values read from files are registered as secrets (see Redact).
+func (doc *Document) Interpolate() error {
+	tree, err := doc.interpolate(doc.Tree, []string{})
+	if err != nil {
+		return err
+	}
+	doc.Tree = tree
+	return nil
+}
+
+func (doc *Document) interpolate(value interface{}, path []string) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		res, err := expand(v, filepath.Dir(doc.File))
+		if err != nil {
+			return nil, doc.Errorf(path, "%v", err)
+		}
+		if scalarReference.MatchString(v) && !strings.HasPrefix(v, "${file:") {
+			if doc.references == nil {
+				doc.references = map[string]bool{}
+			}
+			doc.references[pathKey(path)] = true
+		}
+		return res, nil
+	case map[string]interface{}:
+		for key, item := range v {
+			res, err := doc.interpolate(item, append(path, key))
+			if err != nil {
+				return nil, err
+			}
+			v[key] = res
+		}
+	case []interface{}:
+		for i, item := range v {
+			res, err := doc.interpolate(item, append(path, strconv.Itoa(i)))
+			if err != nil {
+				return nil, err
+			}
+			v[i] = res
+		}
+	}
+	return value, nil
+}
+
+func pathKey(path []string) string {
+	return strings.Join(path, "\x00")
+}
+
+// convertReferences converts the values made of a single reference to
+// the type of the target field, when it's a number or a boolean, so that
+// "${PORT}" can fill a numeric setting while string fields are kept as is
+func (doc *Document) convertReferences(value interface{}, t reflect.Type, path []string) interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch v := value.(type) {
+	case string:
+		if !doc.references[pathKey(path)] {
+			return v
+		}
+		switch t.Kind() {
+		case reflect.Bool:
+			if b, err := strconv.ParseBool(v); err == nil {
+				return b
+			}
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+			if _, err := strconv.ParseFloat(v, 64); err == nil && json.Valid([]byte(v)) {
+				return json.Number(v)
+			}
+		}
+	case map[string]interface{}:
+		// the tree is copied, since a document can be decoded more than once
+		res := map[string]interface{}{}
+		for key, item := range v {
+			res[key] = item
+			switch t.Kind() {
+			case reflect.Map:
+				res[key] = doc.convertReferences(item, t.Elem(), append(path, key))
+			case reflect.Struct:
+				if field, found := fieldByKey(t, key); found {
+					res[key] = doc.convertReferences(item, field.Type, append(path, key))
+				}
+			}
+		}
+		return res
+	case []interface{}:
+		if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			res := make([]interface{}, len(v))
+			for i, item := range v {
+				res[i] = doc.convertReferences(item, t.Elem(), append(path, strconv.Itoa(i)))
+			}
+			return res
+		}
+	}
+
+	return value
+}
+
+// fieldByKey returns the field of the struct bound to key, matching the
+// names like encoding/json does
+func fieldByKey(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			if f, found := fieldByKey(field.Type, key); found {
+				return f, true
+			}
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if strings.EqualFold(name, key) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func expand(value string, dir string) (string, error) {
+	var err error
+
+	res := reference.ReplaceAllStringFunc(value, func(match string) string {
+		if err != nil || match == "$${" {
+			return "${"
+		}
+
+		expr := match[2 : len(match)-1]
+
+		if strings.HasPrefix(expr, "file:") {
+			fileName := expr[5:]
+			if !filepath.IsAbs(fileName) {
+				fileName = filepath.Join(dir, fileName)
+			}
+			data, ferr := ioutil.ReadFile(fileName)
+			if ferr != nil {
+				err = ferr
+				return ""
+			}
+			secret := strings.TrimRight(string(data), "\r\n")
+			RegisterSecret(secret)
+			return secret
+		}
+
+		name, def, hasDefault := strings.Cut(expr, ":-")
+		if name == "" {
+			err = fmt.Errorf("empty reference %s", match)
+			return ""
+		}
+
+		env, found := os.LookupEnv(name)
+		switch {
+		case hasDefault && env == "":
+			return def
+		case !found:
+			err = fmt.Errorf("environment variable %s is not set", name)
+			return ""
+		}
+		return env
+	})
+
+	if err != nil {
+		return "", err
+	}
+	return res, nil
+}
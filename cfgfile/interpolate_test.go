@@ -0,0 +1,98 @@
+package cfgfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInterpolateScalars(m *testing.T) {
+	os.Setenv("CFGFILE_PORT", "5555")
+	os.Setenv("CFGFILE_TLS", "true")
+	os.Setenv("CFGFILE_HOST", "example.org")
+	defer os.Unsetenv("CFGFILE_PORT")
+	defer os.Unsetenv("CFGFILE_TLS")
+	defer os.Unsetenv("CFGFILE_HOST")
+
+	doc, err := Parse("config.yaml", YAML, []byte(
+		"port: ${CFGFILE_PORT}\ntls: ${CFGFILE_TLS}\nhost: ${CFGFILE_HOST}\naddress: ${CFGFILE_HOST}:${CFGFILE_PORT}\n"+
+			"attributes: {rack: \"${CFGFILE_PORT}\"}\nheaders: {X-Token: \"${CFGFILE_PORT}\"}\n"))
+	if err != nil {
+		m.Fatal(err)
+	}
+	err = doc.Interpolate()
+	if err != nil {
+		m.Fatal(err)
+	}
+
+	var cfg struct {
+		Port       int
+		Tls        bool
+		Host       string
+		Address    string
+		Attributes map[string]string
+		Headers    map[string]interface{}
+	}
+	err = doc.DecodeStrict(&cfg)
+	if err != nil {
+		m.Fatal(err)
+	}
+	if cfg.Port != 5555 || !cfg.Tls || cfg.Host != "example.org" || cfg.Address != "example.org:5555" {
+		m.Errorf("bad interpolation: %+v", cfg)
+	}
+
+	// only numeric and boolean fields are converted
+	if cfg.Attributes["rack"] != "5555" || cfg.Headers["X-Token"] != "5555" {
+		m.Errorf("strings expected: %+v", cfg)
+	}
+
+	// the document can be decoded again into other types
+	var other struct{ Port string }
+	err = doc.Decode(&other)
+	if err != nil {
+		m.Fatal(err)
+	}
+	if other.Port != "5555" {
+		m.Errorf("bad port %q", other.Port)
+	}
+}
+
+func TestInterpolateRelativeFile(m *testing.T) {
+	dir, err := ioutil.TempDir("", "cfgfile")
+	if err != nil {
+		m.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "secret"), []byte("1234\n"), 0600)
+	if err != nil {
+		m.Fatal(err)
+	}
+	fileName := filepath.Join(dir, "config.json")
+	err = ioutil.WriteFile(fileName, []byte(`{"password": "${file:secret}"}`), 0644)
+	if err != nil {
+		m.Fatal(err)
+	}
+
+	doc, err := Read(fileName)
+	if err != nil {
+		m.Fatal(err)
+	}
+	err = doc.Interpolate()
+	if err != nil {
+		m.Fatal(err)
+	}
+
+	var cfg struct{ Password string }
+	err = doc.Decode(&cfg)
+	if err != nil {
+		m.Fatal(err)
+	}
+	if cfg.Password != "1234" {
+		m.Errorf("bad password %q", cfg.Password)
+	}
+	if Redact("password 1234") != "password ******" {
+		m.Errorf("secret not registered")
+	}
+}
@@ -0,0 +1,48 @@
+package cfgfile
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+const redacted = "******"
+
+var secrets = struct {
+	sync.RWMutex
+	values []string
+}{}
+
+// RegisterSecret marks the given value as a secret: from now on it will be
+// masked by Redact
+func RegisterSecret(value string) {
+	if value == "" {
+		return
+	}
+
+	secrets.Lock()
+	defer secrets.Unlock()
+
+	for _, v := range secrets.values {
+		if v == value {
+			return
+		}
+	}
+
+	secrets.values = append(secrets.values, value)
+	// longest first, so that a secret containing another one is fully masked
+	sort.Slice(secrets.values, func(i, j int) bool {
+		return len(secrets.values[i]) > len(secrets.values[j])
+	})
+}
+
+// Redact masks every registered secret in the given string
+func Redact(value string) string {
+	secrets.RLock()
+	defer secrets.RUnlock()
+
+	for _, secret := range secrets.values {
+		value = strings.Replace(value, secret, redacted, -1)
+	}
+	return value
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/avalente/riemann-agent/cfgfile"
+	"github.com/avalente/riemann-agent/modules"
+)
+
+// moduleInfo describes a module in the output of the modules command
+type moduleInfo struct {
+	Name       string          `json:"name"`
+	Kind       string          `json:"kind"`
+	Path       string          `json:"path"`
+	Executable string          `json:"executable,omitempty"`
+	Shadows    string          `json:"shadows,omitempty"`
+	Parameters []parameterInfo `json:"parameters"`
+}
+
+type parameterInfo struct {
+	Name        string          `json:"name"`
+	Type        string          `json:"type"`
+	Required    bool            `json:"required"`
+	Default     interface{}     `json:"default"`
+	Description string          `json:"description"`
+	Enum        []interface{}   `json:"enum,omitempty"`
+	Min         *float64        `json:"min,omitempty"`
+	Max         *float64        `json:"max,omitempty"`
+	Pattern     string          `json:"pattern,omitempty"`
+	Items       *parameterInfo  `json:"items,omitempty"`
+	Fields      []parameterInfo `json:"fields,omitempty"`
+}
+
+func newParameterInfo(param modules.ModuleParameter) parameterInfo {
+	info := parameterInfo{param.Name, param.Type, param.Required, param.Default, param.Description,
+		param.Enum, param.Min, param.Max, param.Pattern, nil, nil}
+
+	if param.Items != nil {
+		items := newParameterInfo(*param.Items)
+		info.Items = &items
+	}
+
+	for _, field := range param.Fields {
+		info.Fields = append(info.Fields, newParameterInfo(field))
+	}
+
+	return info
+}
+
+// typeName describes the type of the parameter in the table, with the
+// type of the list items
+func (info parameterInfo) typeName() string {
+	if info.Items != nil {
+		return fmt.Sprintf("%s<%s>", info.Type, info.Items.typeName())
+	}
+	return info.Type
+}
+
+type modulesReport struct {
+	Modules  []moduleInfo `json:"modules"`
+	Warnings []string     `json:"warnings"`
+	Errors   []string     `json:"errors"`
+}
+
+// modulesCommand lists the available modules with their parameters
+func modulesCommand(args []string, stdout, stderr io.Writer) int {
+	flags, configFile, verbose := newFlagSet("modules", stderr)
+	output := flags.String("o", "table", "Output format: table or json")
+	if flags.Parse(args) != nil {
+		return 2
+	}
+
+	if *output != "table" && *output != "json" {
+		flags.Usage()
+		return 2
+	}
+
+	commandLogging(*verbose, stderr)
+
+	cfg, err := GetConfiguration(*configFile)
+	if err != nil {
+		printLine(stderr, "ERROR %s", cfgfile.Redact(err.Error()))
+		return 1
+	}
+
+	report := scanModulesReport(cfg.ModulesDirectory, flags.Args())
+
+	if *output == "json" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			printLine(stderr, "ERROR %v", err)
+			return 1
+		}
+		printLine(stdout, "%s", cfgfile.Redact(string(data)))
+	} else {
+		printModulesTable(stdout, stderr, report)
+	}
+
+	if len(report.Errors) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// scanModulesReport collects the modules as ScanModules does, with the
+// shadowed ones; only the given names are reported, if any
+func scanModulesReport(modulesDir string, names []string) modulesReport {
+	report := modulesReport{Modules: []moduleInfo{}, Warnings: []string{}, Errors: []string{}}
+
+	availableModules, shadowings, errs := modules.ReadModules(modulesDir)
+	for _, err := range errs {
+		report.Errors = append(report.Errors, err.Error())
+	}
+
+	shadows := map[string]string{}
+	for _, s := range shadowings {
+		shadows[s.Module.Name] = s.Shadowed.Location()
+		report.Warnings = append(report.Warnings,
+			fmt.Sprintf("module %s in %s shadows the one in %s", s.Module.Name, s.Module.Location(), s.Shadowed.Location()))
+	}
+
+	wanted := map[string]bool{}
+	for _, name := range names {
+		wanted[name] = true
+		if _, found := availableModules[name]; !found {
+			report.Errors = append(report.Errors, fmt.Sprintf("unknown module: %s", name))
+		}
+	}
+
+	for name, mod := range availableModules {
+		if len(wanted) > 0 && !wanted[name] {
+			continue
+		}
+
+		info := moduleInfo{Name: mod.Name, Kind: mod.Kind, Path: mod.Location(), Shadows: shadows[name],
+			Parameters: []parameterInfo{}}
+		if mod.Kind != "builtin" {
+			info.Executable = mod.Executable
+		}
+		for _, param := range mod.Parameters {
+			info.Parameters = append(info.Parameters, newParameterInfo(param))
+		}
+
+		report.Modules = append(report.Modules, info)
+	}
+
+	sort.Slice(report.Modules, func(i, j int) bool { return report.Modules[i].Name < report.Modules[j].Name })
+
+	return report
+}
+
+// printModulesTable prints the modules to stdout and the problems found to
+// stderr
+func printModulesTable(stdout, stderr io.Writer, report modulesReport) {
+	buf := bytes.Buffer{}
+
+	for _, info := range report.Modules {
+		fmt.Fprintf(&buf, "%s (%s)\n", info.Name, info.Kind)
+		fmt.Fprintf(&buf, "  path: %s\n", info.Path)
+		if info.Executable != "" {
+			fmt.Fprintf(&buf, "  executable: %s\n", info.Executable)
+		}
+		if info.Shadows != "" {
+			fmt.Fprintf(&buf, "  shadows: %s\n", info.Shadows)
+		}
+
+		if len(info.Parameters) > 0 {
+			w := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "  NAME\tTYPE\tREQUIRED\tDEFAULT\tDESCRIPTION")
+			for _, param := range info.Parameters {
+				required := "no"
+				if param.Required {
+					required = "yes"
+				}
+
+				def := "-"
+				if param.Default != nil {
+					data, _ := json.Marshal(param.Default)
+					def = string(data)
+				}
+
+				fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\n", param.Name, param.typeName(), required, def, param.Description)
+			}
+			w.Flush()
+		}
+
+		buf.WriteString("\n")
+	}
+
+	io.WriteString(stdout, cfgfile.Redact(buf.String()))
+
+	for _, warning := range report.Warnings {
+		printLine(stderr, "WARNING %s", cfgfile.Redact(warning))
+	}
+
+	for _, err := range report.Errors {
+		printLine(stderr, "ERROR %s", cfgfile.Redact(err))
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/avalente/riemann-agent/modules"
+)
+
+func createModulesDir(m *testing.T, metadata map[string]string) string {
+	dir, err := ioutil.TempDir(ctx.dir, "modules")
+	if err != nil {
+		m.Fatal(err)
+	}
+
+	for name, content := range metadata {
+		moduleDir := filepath.Join(dir, name)
+		os.Mkdir(moduleDir, 0755)
+
+		err = ioutil.WriteFile(filepath.Join(moduleDir, "metadata.yaml"), []byte(content), 0644)
+		if err != nil {
+			m.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join(moduleDir, name), []byte("#!/bin/sh\n"), 0755)
+		if err != nil {
+			m.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+func TestModulesCommand(m *testing.T) {
+	dir := createModulesDir(m, map[string]string{
+		"ping": "name: ping\nkind: executable\nparameters:\n" +
+			"- {name: target, type: string, required: true, description: Host to check}\n",
+		"broken": "name: broken\n",
+	})
+	configFile := createCF(ctx, `{"ModulesDirectory": "`+dir+`", "Defaults": {"Host": "h"}}`)
+
+	out := bytes.Buffer{}
+	AssertEqual(m, modulesCommand([]string{"-c", configFile, "-o", "json"}, &out, ioutil.Discard), 1)
+
+	report := modulesReport{}
+	err := json.Unmarshal(out.Bytes(), &report)
+	if err != nil {
+		m.Fatal(err)
+	}
+
+	names := []string{}
+	for _, info := range report.Modules {
+		names = append(names, info.Name)
+	}
+	AssertEqual(m, strings.Join(names, ","), "fake,http,ping")
+
+	ping := report.Modules[2]
+	AssertEqual(m, ping.Kind, "executable")
+	AssertEqual(m, ping.Path, filepath.Join(dir, "ping"))
+	AssertEqual(m, ping.Shadows, "builtin")
+	AssertEqual(m, ping.Parameters[0].Description, "Host to check")
+	AssertEqual(m, len(report.Warnings), 1)
+	AssertEqual(m, len(report.Errors), 1)
+}
+
+func TestModulesCommandTable(m *testing.T) {
+	configFile := createCF(ctx, `{"Defaults": {"Host": "h"}}`)
+
+	out := bytes.Buffer{}
+	AssertEqual(m, modulesCommand([]string{"-c", configFile, "http"}, &out, ioutil.Discard), 0)
+
+	lines := strings.Split(out.String(), "\n")
+	AssertEqual(m, lines[0], "http (builtin)")
+	AssertEqual(m, strings.Fields(lines[2])[0], "NAME")
+	AssertEqual(m, strings.Join(strings.Fields(lines[4])[:4], " "), "method string no \"GET\"")
+
+	errOut := bytes.Buffer{}
+	AssertEqual(m, modulesCommand([]string{"-c", configFile, "unknown"}, &out, &errOut), 1)
+	AssertEqual(m, strings.TrimSpace(errOut.String()), "ERROR unknown module: unknown")
+}
+
+func TestModulesReportMatchesReadModules(m *testing.T) {
+	dir := createModulesDir(m, map[string]string{
+		"http":   "name: http\nkind: executable\n",
+		"check":  "name: check\nkind: executable\n",
+		"broken": "name: broken\nparameters:\n- {name: p, type: unknown}\n",
+	})
+
+	available, shadowings, errs := modules.ReadModules(dir)
+	AssertEqual(m, len(shadowings), 1)
+	AssertEqual(m, shadowings[0].Module.Name, "http")
+	AssertEqual(m, shadowings[0].Shadowed.Location(), "builtin")
+
+	report := scanModulesReport(dir, nil)
+
+	names := []string{}
+	for name := range available {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	reported := []string{}
+	for _, info := range report.Modules {
+		reported = append(reported, info.Name)
+		if info.Name == "http" {
+			AssertEqual(m, info.Path, filepath.Join(dir, "http"))
+			AssertEqual(m, info.Shadows, "builtin")
+		}
+	}
+	AssertEqual(m, strings.Join(reported, ","), strings.Join(names, ","))
+	AssertEqual(m, len(report.Errors), len(errs))
+	AssertEqual(m, len(report.Warnings), 1)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/amir/raidman"
+
+	"github.com/avalente/riemann-agent/cfgfile"
+	"github.com/avalente/riemann-agent/modules"
+)
+
+// paramsFlag collects the repeated -p name=value flags; the values are
+// parsed as JSON when possible, so that numbers and booleans keep their
+// type
+type paramsFlag map[string]interface{}
+
+func (p paramsFlag) String() string {
+	return fmt.Sprintf("%v", map[string]interface{}(p))
+}
+
+func (p paramsFlag) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("expected name=value: %s", value)
+	}
+
+	var parsed interface{}
+	if json.Unmarshal([]byte(parts[1]), &parsed) != nil {
+		parsed = parts[1]
+	}
+	p[parts[0]] = parsed
+
+	return nil
+}
+
+// runDriverCommand executes a driver, loaded from file (one per target, if
+// any) or built from a module and its parameters, exactly once and prints
+// the resulting events; the exit code is 1 if the run fails or any event
+// is critical
+func runDriverCommand(args []string, stdout, stderr io.Writer) int {
+	flags, configFile, verbose := newFlagSet("run", stderr)
+	driverFile := flags.String("d", "", "Driver file")
+	module := flags.String("m", "", "Module (instead of a driver file)")
+	params := paramsFlag{}
+	flags.Var(params, "p", "Module parameter as name=value (repeatable)")
+	output := flags.String("o", "table", "Output format: table or json")
+	send := flags.Bool("send", false, "Send the events to riemann")
+	if flags.Parse(args) != nil {
+		return 2
+	}
+
+	if (*driverFile == "") == (*module == "") || (*output != "table" && *output != "json") {
+		flags.Usage()
+		return 2
+	}
+
+	commandLogging(*verbose, stderr)
+
+	fail := func(err error) int {
+		printLine(stderr, "ERROR %s", cfgfile.Redact(err.Error()))
+		return 1
+	}
+
+	cfg, err := GetConfiguration(*configFile)
+	if err != nil {
+		return fail(err)
+	}
+	setAgentHostname(cfg.Defaults.Host)
+
+	availableModules := modules.ScanModules(cfg.ModulesDirectory)
+
+	var drivers []*Driver
+	if *driverFile != "" {
+		drivers, err = ReadDriver(*driverFile, availableModules, cfg)
+	} else {
+		var drv *Driver
+		drv, err = inlineDriver(*module, params, availableModules, cfg)
+		drivers = []*Driver{drv}
+	}
+	if err != nil {
+		return fail(err)
+	}
+	if len(drivers) == 0 {
+		return fail(fmt.Errorf("no driver in %s", *driverFile))
+	}
+
+	events := modules.EventList{}
+	for _, drv := range drivers {
+		err = drv.Start()
+		if err != nil {
+			return fail(fmt.Errorf("%s: %v", drv.Id, err))
+		}
+		driverEvents, err := drv.Collect()
+		drv.Stop()
+		if err != nil {
+			return fail(fmt.Errorf("%s: %v", drv.Id, err))
+		}
+		events = append(events, driverEvents...)
+	}
+
+	if *output == "json" {
+		err = printEventsJson(stdout, events)
+	} else {
+		err = printEventsTable(stdout, events)
+	}
+	if err != nil {
+		return fail(err)
+	}
+
+	if *send {
+		err = sendEvents(cfg, events)
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	for _, ev := range events {
+		if ev.State == "critical" {
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// inlineDriver builds a driver running the module with the given
+// parameters and the default options
+func inlineDriver(module string, params map[string]interface{}, availableModules map[string]modules.Module, cfg *Configuration) (*Driver, error) {
+	data, err := json.Marshal(map[string]interface{}{"description": module, "module": module, "configuration": params})
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := cfgfile.Parse("<command line>", cfgfile.JSON, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewDriver(doc, availableModules, cfg)
+}
+
+func printEventsJson(stdout io.Writer, events modules.EventList) error {
+	data, err := json.MarshalIndent(events, "", "  ")
+	if err != nil {
+		return err
+	}
+	printLine(stdout, "%s", cfgfile.Redact(string(data)))
+	return nil
+}
+
+func printEventsTable(stdout io.Writer, events modules.EventList) error {
+	buf := bytes.Buffer{}
+	w := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(w, "HOST\tSERVICE\tSTATE\tMETRIC\tDESCRIPTION")
+	for _, ev := range events {
+		metric := ""
+		if ev.Metric != nil {
+			metric = fmt.Sprintf("%v", ev.Metric)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", ev.Host, ev.Service, ev.State, metric, ev.Description)
+	}
+
+	err := w.Flush()
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(stdout, cfgfile.Redact(buf.String()))
+	return err
+}
+
+// sendEvents sends the events to the configured riemann
+func sendEvents(cfg *Configuration, events []*raidman.Event) error {
+	conn, err := raidman.Dial(cfg.RiemannProtocol, cfg.RiemannHost)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, ev := range events {
+		err = conn.Send(ev)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunDriverCommandInline(m *testing.T) {
+	configFile := createCF(ctx, `{"Defaults": {"Host": "h"}}`)
+
+	// the log of -v goes to stderr, keeping the JSON parseable
+	out, errOut := bytes.Buffer{}, bytes.Buffer{}
+	code := runDriverCommand([]string{"-c", configFile, "-m", "fake", "-p", "attribute=x", "-p", "value1=7", "-o", "json", "-v"},
+		&out, &errOut)
+	AssertEqual(m, code, 0)
+	if errOut.Len() == 0 {
+		m.Errorf("log expected on stderr")
+	}
+
+	events := []map[string]interface{}{}
+	err := json.Unmarshal(out.Bytes(), &events)
+	if err != nil {
+		m.Fatal(err)
+	}
+	AssertEqual(m, len(events), 2)
+	AssertEqual(m, events[0]["host"], "h")
+	AssertEqual(m, events[0]["service"], "fake")
+	AssertEqual(m, events[0]["metric"], 7.0)
+	AssertEqual(m, events[1]["metric"], 42.0)
+}
+
+func TestRunDriverCommandFile(m *testing.T) {
+	dir := createDriversDir(m, map[string]string{
+		"a.yaml": "description: a\nmodule: fake\nservice: 'fake %tag'\nthresholds: {critical: 10}\n" +
+			"configuration: {attribute: x, value1: 1}\n",
+	})
+	configFile := createCF(ctx, `{"Defaults": {"Host": "h"}}`)
+
+	out := bytes.Buffer{}
+	code := runDriverCommand([]string{"-c", configFile, "-d", filepath.Join(dir, "a.yaml")}, &out, ioutil.Discard)
+	AssertEqual(m, code, 1)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	AssertEqual(m, len(lines), 3)
+	AssertEqual(m, strings.Fields(lines[0])[0], "HOST")
+	AssertEqual(m, strings.Join(strings.Fields(lines[1])[:5], " "), "h fake value1 ok 1")
+	AssertEqual(m, strings.Join(strings.Fields(lines[2])[:5], " "), "h fake value2 critical 42")
+}
+
+func TestRunDriverCommandErrors(m *testing.T) {
+	configFile := createCF(ctx, `{"Defaults": {"Host": "h"}}`)
+
+	out, errOut := bytes.Buffer{}, bytes.Buffer{}
+	AssertEqual(m, runDriverCommand([]string{"-c", configFile}, ioutil.Discard, ioutil.Discard), 2)
+	AssertEqual(m, runDriverCommand([]string{"-c", configFile, "-m", "fake"}, &out, &errOut), 1)
+	AssertEqual(m, out.Len(), 0)
+	if !strings.HasPrefix(errOut.String(), "ERROR ") {
+		m.Errorf("error expected: %s", errOut.String())
+	}
+}
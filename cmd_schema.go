@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/avalente/riemann-agent/cfgfile"
+	"github.com/avalente/riemann-agent/modules"
+)
+
+// schemaCommand prints the JSON Schema of the driver files, or of the
+// configuration of a single module
+func schemaCommand(args []string, stdout, stderr io.Writer) int {
+	flags, configFile, verbose := newFlagSet("schema", stderr)
+	module := flags.String("m", "", "Print only the schema of the module configuration")
+	if flags.Parse(args) != nil {
+		return 2
+	}
+
+	commandLogging(*verbose, stderr)
+
+	fail := func(err error) int {
+		printLine(stderr, "ERROR %s", cfgfile.Redact(err.Error()))
+		return 1
+	}
+
+	cfg, err := GetConfiguration(*configFile)
+	if err != nil {
+		return fail(err)
+	}
+
+	availableModules := modules.ScanModules(cfg.ModulesDirectory)
+
+	var schema jsonSchema
+	if *module != "" {
+		mod, found := availableModules[*module]
+		if !found {
+			return fail(fmt.Errorf("unknown module: %s", *module))
+		}
+		schema = ModuleSchema(mod)
+		schema["$schema"] = jsonSchemaVersion
+		schema["title"] = "riemann-agent " + mod.Name + " configuration"
+	} else {
+		schema = DriverSchema(availableModules)
+	}
+
+	data, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return fail(err)
+	}
+	printLine(stdout, "%s", data)
+
+	return 0
+}
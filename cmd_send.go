@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/amir/raidman"
+
+	"github.com/avalente/riemann-agent/cfgfile"
+)
+
+// attributesFlag collects the repeated -a name=value flags
+type attributesFlag map[string]string
+
+func (a attributesFlag) String() string {
+	return fmt.Sprintf("%v", map[string]string(a))
+}
+
+func (a attributesFlag) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("expected name=value: %s", value)
+	}
+	a[parts[0]] = parts[1]
+	return nil
+}
+
+func sendCommand(args []string, stdout, stderr io.Writer) int {
+	return sendEventCommand(args, os.Stdin, stderr)
+}
+
+// sendEventCommand sends an event, built from the flags or read as JSON
+// from stdin, to riemann or to a running agent through its socket
+func sendEventCommand(args []string, stdin io.Reader, stderr io.Writer) int {
+	flags, configFile, verbose := newFlagSet("send", stderr)
+	host := flags.String("host", "", "Host (default: the configured one)")
+	service := flags.String("service", "", "Service")
+	state := flags.String("state", "", "State")
+	metric := flags.String("metric", "", "Metric")
+	description := flags.String("description", "", "Description")
+	tags := flags.String("tags", "", "Comma-separated tags")
+	attributes := attributesFlag{}
+	flags.Var(attributes, "a", "Attribute as name=value (repeatable)")
+	ttl := flags.Float64("ttl", 0, "Ttl (default: the configured one)")
+	fromStdin := flags.Bool("json", false, "Read the event as JSON from stdin")
+	socket := flags.String("socket", "", "Hand the event to the agent listening on this socket")
+	if flags.Parse(args) != nil {
+		return 2
+	}
+
+	commandLogging(*verbose, stderr)
+
+	fail := func(err error) int {
+		printLine(stderr, "ERROR %s", cfgfile.Redact(err.Error()))
+		return 1
+	}
+
+	ev := &raidman.Event{}
+
+	if *fromStdin {
+		err := json.NewDecoder(stdin).Decode(ev)
+		if err != nil {
+			return fail(fmt.Errorf("bad event: %v", err))
+		}
+		err = normalizeMetric(ev)
+		if err != nil {
+			return fail(err)
+		}
+	} else {
+		ev.Host = *host
+		ev.Service = *service
+		ev.State = *state
+		ev.Description = *description
+		ev.Ttl = float32(*ttl)
+
+		if *metric != "" {
+			value, err := parseMetric(*metric)
+			if err != nil {
+				return fail(err)
+			}
+			ev.Metric = value
+		}
+
+		if *tags != "" {
+			ev.Tags = strings.Split(*tags, ",")
+		}
+
+		if len(attributes) > 0 {
+			ev.Attributes = attributes
+		}
+	}
+
+	if ev.Service == "" {
+		return fail(fmt.Errorf("service required"))
+	}
+
+	// the agent completes the event with its defaults
+	if *socket != "" {
+		err := sendToSocket(*socket, []*raidman.Event{ev})
+		if err != nil {
+			return fail(err)
+		}
+		return 0
+	}
+
+	cfg, err := GetConfiguration(*configFile)
+	if err != nil {
+		return fail(err)
+	}
+
+	if ev.Host == "" {
+		ev.Host = cfg.Defaults.Host
+	}
+	if ev.Ttl == 0 {
+		ev.Ttl = cfg.Defaults.Ttl
+	}
+	if ev.Time == 0 {
+		ev.Time = time.Now().Unix()
+	}
+
+	err = sendEvents(cfg, []*raidman.Event{ev})
+	if err != nil {
+		return fail(err)
+	}
+
+	return 0
+}
+
+// parseMetric keeps integer metrics as integers
+func parseMetric(value string) (interface{}, error) {
+	i, err := strconv.ParseInt(value, 10, 64)
+	if err == nil {
+		return i, nil
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad metric: %s", value)
+	}
+	return f, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/amir/raidman"
+)
+
+func TestSendCommandSocket(m *testing.T) {
+	queue := make(ResQueue, 10)
+	path := filepath.Join(ctx.dir, "agent.sock")
+
+	a, fired := newTestAlerter(m, []AlertRule{{Name: "deploy", Service: "^deploy$", Webhook: "http://localhost/hook"}})
+	l, err := NewSocketListener(path, queue, EventDefaults{Host: "agent-host", Ttl: 60, Tags: []string{"agent"},
+		Attributes: map[string]string{"version": "0", "dc": "eu"}}, a)
+	if err != nil {
+		m.Fatal(err)
+	}
+	defer l.Stop()
+
+	out := bytes.Buffer{}
+	code := sendEventCommand([]string{"-socket", path, "-service", "deploy", "-state", "ok", "-metric", "3",
+		"-tags", "a,b", "-a", "version=1.2"}, nil, &out)
+	AssertEqual(m, code, 0)
+
+	ev := <-queue
+	AssertEqual(m, ev.Host, "agent-host")
+	AssertEqual(m, ev.Service, "deploy")
+	AssertEqual(m, ev.Metric, 3.0)
+	AssertEqual(m, ev.Ttl, float32(60))
+	AssertEqual(m, strings.Join(ev.Tags, ","), "agent,a,b")
+	AssertEqual(m, ev.Attributes["version"], "1.2")
+	AssertEqual(m, ev.Attributes["dc"], "eu")
+	AssertEqual(m, (<-fired)["rule"], "deploy")
+
+	stdin := strings.NewReader(`{"host": "other", "service": "backup", "state": "critical", "ttl": 10}`)
+	code = sendEventCommand([]string{"-socket", path, "-json"}, stdin, &out)
+	AssertEqual(m, code, 0)
+
+	ev = <-queue
+	AssertEqual(m, ev.Host, "other")
+	AssertEqual(m, ev.State, "critical")
+	AssertEqual(m, ev.Ttl, float32(10))
+}
+
+func TestSendCommandErrors(m *testing.T) {
+	out := bytes.Buffer{}
+	AssertEqual(m, sendEventCommand([]string{"-state", "ok"}, nil, &out), 1)
+	AssertEqual(m, sendEventCommand([]string{"-service", "a", "-metric", "x"}, nil, &out), 1)
+	AssertEqual(m, sendEventCommand([]string{"-json"}, strings.NewReader("{"), &out), 1)
+	AssertEqual(m, sendEventCommand([]string{"-json"}, strings.NewReader(`{"service": "x", "metric": "abc"}`), &out), 1)
+	AssertEqual(m, sendEventCommand([]string{"-service", "a", "-socket", filepath.Join(ctx.dir, "none.sock")}, nil, &out), 1)
+}
+
+func TestParseMetric(m *testing.T) {
+	value, _ := parseMetric("42")
+	AssertEqual(m, value, int64(42))
+
+	value, _ = parseMetric("0.5")
+	AssertEqual(m, value, 0.5)
+}
+
+func TestSocketListenerOwnership(m *testing.T) {
+	path := filepath.Join(ctx.dir, "owned.sock")
+
+	l, err := NewSocketListener(path, make(ResQueue, 10), EventDefaults{}, nil)
+	if err != nil {
+		m.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		m.Fatal(err)
+	}
+	AssertEqual(m, info.Mode().Perm(), os.FileMode(0600))
+
+	// the socket of a live agent is kept
+	_, err = NewSocketListener(path, make(ResQueue, 10), EventDefaults{}, nil)
+	if err == nil || !strings.Contains(err.Error(), "in use") {
+		m.Fatalf("in use error expected, found %v", err)
+	}
+	err = sendToSocket(path, []*raidman.Event{{Service: "s"}})
+	if err != nil {
+		m.Fatal(err)
+	}
+
+	// a stale one is replaced
+	l.listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.listener.Close()
+	l, err = NewSocketListener(path, make(ResQueue, 10), EventDefaults{}, nil)
+	if err != nil {
+		m.Fatal(err)
+	}
+	l.Stop()
+}
+
+func TestSocketListenerBadMetric(m *testing.T) {
+	queue := make(ResQueue, 10)
+	path := filepath.Join(ctx.dir, "metric.sock")
+
+	l, err := NewSocketListener(path, queue, EventDefaults{}, nil)
+	if err != nil {
+		m.Fatal(err)
+	}
+	defer l.Stop()
+
+	err = sendToSocket(path, []*raidman.Event{{Service: "x", Metric: "abc"}})
+	if err == nil || !strings.Contains(err.Error(), "error bad metric") {
+		m.Fatalf("bad metric error expected, found %v", err)
+	}
+	AssertEqual(m, len(queue), 0)
+
+	// numeric strings are converted
+	err = sendToSocket(path, []*raidman.Event{{Service: "x", Metric: "12"}})
+	if err != nil {
+		m.Fatal(err)
+	}
+	AssertEqual(m, (<-queue).Metric, 12.0)
+}
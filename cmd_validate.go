@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io"
+
+	"github.com/avalente/riemann-agent/cfgfile"
+	"github.com/avalente/riemann-agent/modules"
+)
+
+// validateCommand checks the configuration, the modules and the drivers
+// without starting anything, printing every problem found
+func validateCommand(args []string, stdout, stderr io.Writer) int {
+	flags, configFile, verbose := newFlagSet("validate", stderr)
+	if flags.Parse(args) != nil {
+		return 2
+	}
+
+	commandLogging(*verbose, stderr)
+
+	cfg, err := GetConfiguration(*configFile)
+	if err != nil {
+		printLine(stderr, "ERROR %s", cfgfile.Redact(err.Error()))
+		return 1
+	}
+
+	availableModules, _, errs := modules.ReadModules(cfg.ModulesDirectory)
+
+	drivers, driverErrs := ReadDrivers(availableModules, cfg)
+	errs = append(errs, driverErrs...)
+	errs = append(errs, checkParameters(drivers)...)
+
+	for _, err := range errs {
+		printLine(stderr, "ERROR %s", cfgfile.Redact(err.Error()))
+	}
+
+	printLine(stdout, "%d modules, %d drivers, %d problems", len(availableModules), len(drivers), len(errs))
+
+	if len(errs) > 0 {
+		return 1
+	}
+	return 0
+}
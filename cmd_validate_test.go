@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestValidateCommand(m *testing.T) {
+	dir := createDriversDir(m, map[string]string{
+		"a.yaml": "description: a\nmodule: ping\nconfiguration: {target: localhost}\n",
+		"b.yaml": "description: b\nmodule: unknown\n",
+		"c.yaml": "description: c\nmodule: ping\n",
+		"d.yaml": "description: d\nmodule: ping\nservice: '{{.Bad'\nconfiguration: {target: localhost}\n",
+	})
+	configFile := createCF(ctx, `{"DriversDirectory": "`+dir+`", "Defaults": {"Host": "h"}}`)
+
+	out, errOut := bytes.Buffer{}, bytes.Buffer{}
+	AssertEqual(m, validateCommand([]string{"-c", configFile}, &out, &errOut), 1)
+
+	lines := strings.Split(strings.TrimSpace(errOut.String()), "\n")
+	AssertEqual(m, len(lines), 3)
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "ERROR ") {
+			m.Errorf("bad line: %s", line)
+		}
+	}
+	if !strings.HasSuffix(strings.TrimSpace(out.String()), "2 drivers, 3 problems") {
+		m.Errorf("bad summary: %s", out.String())
+	}
+}
+
+func TestValidateCommandValid(m *testing.T) {
+	dir := createDriversDir(m, map[string]string{
+		"a.yaml": "description: a\nmodule: ping\nconfiguration: {target: localhost}\n",
+	})
+	configFile := createCF(ctx, `{"DriversDirectory": "`+dir+`", "Defaults": {"Host": "h"}}`)
+
+	out := bytes.Buffer{}
+	AssertEqual(m, validateCommand([]string{"-c", configFile}, &out, &out), 0)
+
+	out.Reset()
+	AssertEqual(m, validateCommand([]string{"-c", createCF(ctx, `{"Workers": 0}`)}, &out, &out), 1)
+}
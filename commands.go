@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/op/go-logging"
+)
+
+// commands are the subcommands of the agent, run with their arguments and
+// returning the exit code; without a subcommand the agent runs. The
+// results go to stdout, the errors and the log to stderr.
+var commands = map[string]func(args []string, stdout, stderr io.Writer) int{
+	"validate": validateCommand,
+	"run":      runDriverCommand,
+	"send":     sendCommand,
+	"modules":  modulesCommand,
+	"schema":   schemaCommand,
+}
+
+// runCommand runs the subcommand named by the first argument, if any
+func runCommand(args []string) (int, bool) {
+	if len(args) == 0 {
+		return 0, false
+	}
+
+	command, found := commands[args[0]]
+	if !found {
+		return 0, false
+	}
+
+	return command(args[1:], os.Stdout, os.Stderr), true
+}
+
+func commandNames() string {
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// newFlagSet returns the flags of a subcommand, with the usual -c and -v
+func newFlagSet(name string, stderr io.Writer) (*flag.FlagSet, *string, *bool) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configFile := flags.String("c", "config.json", "Configuration file")
+	verbose := flags.Bool("v", false, "Verbose")
+	return flags, configFile, verbose
+}
+
+// commandLogging sends the log to stderr when verbose, otherwise discards
+// it, since the subcommands report on stdout
+func commandLogging(verbose bool, stderr io.Writer) {
+	if verbose {
+		consoleLogging(stderr, logging.DEBUG)
+	} else {
+		logging.SetBackend(logging.NewLogBackend(ioutil.Discard, "", 0))
+	}
+}
+
+func printLine(out io.Writer, format string, args ...interface{}) {
+	fmt.Fprintf(out, format+"\n", args...)
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
-	"encoding/json"
-	"errors"
+	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+
+	"github.com/avalente/riemann-agent/cfgfile"
 )
 
 type Configuration struct {
@@ -16,10 +19,81 @@ type Configuration struct {
 	LogFile          string
 	LogLevel         string
 	PidFile          string
+	Defaults         EventDefaults
+	Alerts           []AlertRule
+	// size of the pool running the drivers
+	Workers int
+	// maximum number of concurrent runs, by module name
+	ModuleConcurrency map[string]int
+	// reload automatically when the configuration file, the drivers or the
+	// modules change, after WatchDebounce seconds without further changes
+	Watch         bool
+	WatchDebounce int
+	// Unix socket accepting events from the send command
+	Socket string
+}
+
+// EventDefaults are applied to every driver, unless overridden in the
+// driver file; tags and attributes are merged with the driver ones.
+// Splay offsets the first run of each driver by a deterministic fraction
+// of its interval, Jitter delays each run by up to the given seconds.
+type EventDefaults struct {
+	Host       string
+	Fqdn       bool
+	Tags       []string
+	Attributes map[string]string
+	Ttl        float32
+	Interval   int
+	Splay      bool
+	Jitter     int
 }
 
 func NewConfiguration() *Configuration {
-	return &Configuration{"custom-modules", "drivers", "localhost:5555", "udp", "-", "info", ""}
+	return &Configuration{"custom-modules", "drivers", "localhost:5555", "udp", "-", "info", "",
+		EventDefaults{Ttl: 60, Interval: 30}, nil, 16, nil, false, 2, ""}
+}
+
+// defaultHost returns the machine host name, fully qualified if requested
+func defaultHost(fqdn bool) (string, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+
+	if fqdn {
+		name, err := lookupFqdn(host)
+		if err != nil {
+			log.Warning("Can't get the fully qualified name of %s: %v", host, err)
+		} else {
+			host = name
+		}
+	}
+
+	return host, nil
+}
+
+// lookupFqdn resolves host and returns the first qualified name found by a
+// reverse lookup of its addresses
+func lookupFqdn(host string) (string, error) {
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		return "", err
+	}
+
+	for _, addr := range addrs {
+		names, err := net.LookupAddr(addr)
+		if err != nil {
+			continue
+		}
+		for _, name := range names {
+			name = strings.TrimSuffix(name, ".")
+			if strings.Contains(name, ".") {
+				return name, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("no qualified name for %s", host)
 }
 
 func normalizePath(configFile string, fileName string) string {
@@ -32,24 +106,70 @@ func normalizePath(configFile string, fileName string) string {
 }
 
 func GetConfiguration(fileName string) (*Configuration, error) {
-	file, err := os.Open(fileName)
-	defer file.Close()
+	doc, err := cfgfile.Read(fileName)
+	if err != nil {
+		return nil, err
+	}
+	err = doc.Interpolate()
 	if err != nil {
 		return nil, err
 	}
-	decoder := json.NewDecoder(file)
 	cfg := NewConfiguration()
-	err = decoder.Decode(cfg)
+	err = doc.Decode(cfg)
 	if err != nil {
 		return nil, err
 	}
 
 	if cfg.RiemannProtocol != "tcp" && cfg.RiemannProtocol != "udp" {
-		return nil, errors.New("Bad riemann protocol")
+		return nil, doc.Errorf([]string{"RiemannProtocol"}, "Bad riemann protocol")
 	}
 
 	if cfg.DriversDirectory == "" {
-		return nil, errors.New("Empty drivers directory")
+		return nil, doc.Errorf([]string{"DriversDirectory"}, "Empty drivers directory")
+	}
+
+	if cfg.Defaults.Interval <= 0 {
+		return nil, doc.Errorf([]string{"Defaults", "Interval"}, "Bad default interval: %d", cfg.Defaults.Interval)
+	}
+
+	if cfg.Defaults.Jitter < 0 {
+		return nil, doc.Errorf([]string{"Defaults", "Jitter"}, "Bad default jitter: %d", cfg.Defaults.Jitter)
+	}
+
+	if cfg.Defaults.Ttl < 0 {
+		return nil, doc.Errorf([]string{"Defaults", "Ttl"}, "Bad default ttl: %v", cfg.Defaults.Ttl)
+	}
+
+	if cfg.Defaults.Host == "" {
+		cfg.Defaults.Host, err = defaultHost(cfg.Defaults.Fqdn)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Workers <= 0 {
+		return nil, doc.Errorf([]string{"Workers"}, "Bad number of workers: %d", cfg.Workers)
+	}
+
+	if cfg.WatchDebounce < 0 {
+		return nil, doc.Errorf([]string{"WatchDebounce"}, "Bad watch debounce: %d", cfg.WatchDebounce)
+	}
+
+	for module, limit := range cfg.ModuleConcurrency {
+		if limit <= 0 {
+			return nil, doc.Errorf([]string{"ModuleConcurrency", module}, "Bad concurrency for module %s: %d", module, limit)
+		}
+	}
+
+	for i := range cfg.Alerts {
+		rule := &cfg.Alerts[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("alert-%d", i+1)
+		}
+		err = rule.Validate()
+		if err != nil {
+			return nil, doc.Errorf([]string{"Alerts", strconv.Itoa(i)}, "%v", err)
+		}
 	}
 
 	cfg.DriversDirectory = normalizePath(fileName, cfg.DriversDirectory)
@@ -58,5 +178,9 @@ func GetConfiguration(fileName string) (*Configuration, error) {
 		cfg.ModulesDirectory = normalizePath(fileName, cfg.ModulesDirectory)
 	}
 
+	if cfg.Socket != "" {
+		cfg.Socket = normalizePath(fileName, cfg.Socket)
+	}
+
 	return cfg, nil
 }
@@ -7,6 +7,11 @@ import (
 	"regexp"
 	"strings"
 	"testing"
+
+	"github.com/amir/raidman"
+
+	"github.com/avalente/riemann-agent/cfgfile"
+	"github.com/avalente/riemann-agent/modules"
 )
 
 type Ctx struct {
@@ -33,6 +38,19 @@ func createCF(ctx Ctx, content string) string {
 	return file.Name()
 }
 
+func createCFExt(ctx Ctx, ext string, content string) string {
+	file, err := ioutil.TempFile(ctx.dir, "config*"+ext)
+	if err != nil {
+		panic(err)
+	}
+
+	defer file.Close()
+
+	file.Write([]byte(content))
+
+	return file.Name()
+}
+
 func setUp() Ctx {
 	tmpdir, err := ioutil.TempDir("", "test-")
 	if err != nil {
@@ -173,3 +191,137 @@ func TestGetConfigurationRelativePaths(m *testing.T) {
 	AssertEqual(m, cfg.ModulesDirectory, filepath.Join(ctx.dir, "mod"))
 
 }
+
+func TestGetConfigurationYaml(m *testing.T) {
+	file := createCFExt(ctx, ".yaml", "riemannprotocol: tcp\nriemannhost: riemann:5555\n")
+	cfg, err := GetConfiguration(file)
+
+	if err != nil {
+		m.Fatalf("No errors expected, found %s", err.Error())
+	}
+
+	AssertEqual(m, cfg.RiemannProtocol, "tcp")
+	AssertEqual(m, cfg.RiemannHost, "riemann:5555")
+	AssertEqual(m, cfg.LogLevel, "info")
+}
+
+func TestGetConfigurationToml(m *testing.T) {
+	file := createCFExt(ctx, ".toml", "RiemannProtocol = \"tcp\"\nLogLevel = \"debug\"\n")
+	cfg, err := GetConfiguration(file)
+
+	if err != nil {
+		m.Fatalf("No errors expected, found %s", err.Error())
+	}
+
+	AssertEqual(m, cfg.RiemannProtocol, "tcp")
+	AssertEqual(m, cfg.LogLevel, "debug")
+	AssertEqual(m, cfg.RiemannHost, "localhost:5555")
+}
+
+func TestGetConfigurationJsonSyntaxErrorLine(m *testing.T) {
+	file := createCFExt(ctx, ".json", "{\n  \"loglevel\": \"info\",\n  \"logfile\" \"-\"\n}")
+	cfg, err := GetConfiguration(file)
+
+	checkNoResults(m, cfg)
+	checkError(m, err, regexp.QuoteMeta(filepath.Base(file))+":3:")
+}
+
+func TestGetConfigurationYamlTypeErrorLine(m *testing.T) {
+	file := createCFExt(ctx, ".yml", "loglevel: info\nlogfile:\n  - a\n")
+	cfg, err := GetConfiguration(file)
+
+	checkNoResults(m, cfg)
+	checkError(m, err, ":2: bad value for logfile")
+}
+
+func TestGetConfigurationTomlValidationErrorLine(m *testing.T) {
+	file := createCFExt(ctx, ".toml", "loglevel = \"info\"\n\nriemannprotocol = \"xxx\"\n")
+	cfg, err := GetConfiguration(file)
+
+	checkNoResults(m, cfg)
+	checkError(m, err, ":3: bad riemann protocol")
+}
+
+func TestGetConfigurationInterpolation(m *testing.T) {
+	os.Setenv("RA_TEST_HOST", "riemann.example.com:5555")
+	defer os.Unsetenv("RA_TEST_HOST")
+
+	file := createCFExt(ctx, ".yaml", "riemannhost: ${RA_TEST_HOST}\nloglevel: ${RA_TEST_UNSET:-warning}\nlogfile: $${literal}\n")
+	cfg, err := GetConfiguration(file)
+
+	if err != nil {
+		m.Fatalf("No errors expected, found %s", err.Error())
+	}
+
+	AssertEqual(m, cfg.RiemannHost, "riemann.example.com:5555")
+	AssertEqual(m, cfg.LogLevel, "warning")
+	AssertEqual(m, cfg.LogFile, "${literal}")
+}
+
+func TestGetConfigurationInterpolationUnsetVariable(m *testing.T) {
+	file := createCFExt(ctx, ".json", "{\n  \"loglevel\": \"info\",\n  \"riemannhost\": \"${RA_TEST_UNSET}\"\n}")
+	cfg, err := GetConfiguration(file)
+
+	checkNoResults(m, cfg)
+	checkError(m, err, ":3: environment variable RA_TEST_UNSET is not set")
+}
+
+func TestGetConfigurationSecretFile(m *testing.T) {
+	secret := createCF(ctx, "s3cr3t-t0k3n\n")
+	file := createCFExt(ctx, ".toml", "riemannhost = \"${file:"+secret+"}\"\n")
+	cfg, err := GetConfiguration(file)
+
+	if err != nil {
+		m.Fatalf("No errors expected, found %s", err.Error())
+	}
+
+	AssertEqual(m, cfg.RiemannHost, "s3cr3t-t0k3n")
+	AssertEqual(m, cfgfile.Redact("host is "+cfg.RiemannHost), "host is ******")
+}
+
+func TestGetConfigurationEventDefaults(m *testing.T) {
+	file := createCFExt(ctx, ".yaml", "defaults:\n  tags: [agent]\n  attributes: {dc: eu1}\n  ttl: 120\n")
+	cfg, err := GetConfiguration(file)
+
+	if err != nil {
+		m.Fatalf("No errors expected, found %s", err.Error())
+	}
+
+	hostname, _ := os.Hostname()
+	AssertEqual(m, cfg.Defaults.Host, hostname)
+	AssertEqual(m, cfg.Defaults.Interval, 30)
+	AssertEqual(m, cfg.Defaults.Ttl, float32(120))
+	AssertEqual(m, cfg.Defaults.Tags[0], "agent")
+	AssertEqual(m, cfg.Defaults.Attributes["dc"], "eu1")
+}
+
+func TestGetConfigurationAgentHostname(m *testing.T) {
+	file := createCFExt(ctx, ".yaml", "defaults:\n  host: agent.example.org\n")
+	hostname := agentHostname()
+	cfg, err := GetConfiguration(file)
+	if err != nil {
+		m.Fatalf("No errors expected, found %s", err.Error())
+	}
+
+	// set only when the configuration is applied
+	AssertEqual(m, agentHostname(), hostname)
+
+	setAgentHostname(cfg.Defaults.Host)
+	defer setAgentHostname("")
+
+	drv := Driver{Id: "a", Description: "a", Host: "{{.Hostname}}"}
+	if err := drv.compileTemplates(); err != nil {
+		m.Fatal(err)
+	}
+	ev := raidman.Event{}
+	drv.completeEvent(&ev, modules.ModuleParamList{})
+	AssertEqual(m, ev.Host, "agent.example.org")
+}
+
+func TestGetConfigurationBadDefaultInterval(m *testing.T) {
+	file := createCF(ctx, "{\"defaults\": {\"interval\": 0}}")
+	cfg, err := GetConfiguration(file)
+
+	checkNoResults(m, cfg)
+	checkError(m, err, "bad default interval")
+}
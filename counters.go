@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/amir/raidman"
+)
+
+// Counters selects the services whose metric is a monotonically increasing
+// counter, to be sent as a per-second rate
+type Counters struct {
+	// glob patterns of the counter services
+	Services []string
+	// maximum value of the counters (e.g. 4294967295 for 32 bit counters):
+	// a decrease is considered a wrap if the resulting delta is less than
+	// half of this value, otherwise (or if not set) a reset
+	Wrap float64
+}
+
+func (c *Counters) Validate() error {
+	for _, pattern := range c.Services {
+		_, err := CompileGlob(pattern)
+		if err != nil {
+			return fmt.Errorf("bad counter pattern: %v", err)
+		}
+	}
+
+	if c.Wrap < 0 {
+		return fmt.Errorf("bad counter wrap value: %v", c.Wrap)
+	}
+
+	return nil
+}
+
+func (c *Counters) isCounter(service string) bool {
+	for _, pattern := range c.Services {
+		if matchGlob(pattern, service) {
+			return true
+		}
+	}
+	return false
+}
+
+type counterSample struct {
+	value float64
+	time  time.Time
+}
+
+// counterTracker keeps the last sample of every counter, by host and service
+type counterTracker struct {
+	sync.Mutex
+	samples map[[2]string]counterSample
+}
+
+func newCounterTracker() *counterTracker {
+	return &counterTracker{samples: map[[2]string]counterSample{}}
+}
+
+// Rate replaces the metric of the event with the rate since the previous
+// sample; it returns false if the event must be suppressed (first sample,
+// reset or no time elapsed)
+func (c *Counters) Rate(tracker *counterTracker, ev *raidman.Event, now time.Time) bool {
+	if !c.isCounter(ev.Service) {
+		return true
+	}
+
+	value, ok := metricValue(ev)
+	if !ok {
+		return true
+	}
+
+	tracker.Lock()
+	defer tracker.Unlock()
+
+	key := [2]string{ev.Host, ev.Service}
+	prev, found := tracker.samples[key]
+	tracker.samples[key] = counterSample{value, now}
+
+	if !found {
+		return false
+	}
+
+	elapsed := now.Sub(prev.time).Seconds()
+	if elapsed <= 0 {
+		return false
+	}
+
+	delta := value - prev.value
+	if delta < 0 {
+		wrapped := c.Wrap - prev.value + value + 1
+		if c.Wrap == 0 || prev.value > c.Wrap || wrapped > c.Wrap/2 {
+			log.Debug("Counter %s on %s reset (%v -> %v)", ev.Service, ev.Host, prev.value, value)
+			return false
+		}
+		delta = wrapped
+	}
+
+	rate := delta / elapsed
+	if math.IsInf(rate, 0) || math.IsNaN(rate) {
+		return false
+	}
+
+	ev.Metric = rate
+	return true
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/amir/raidman"
+)
+
+func TestCountersRate(m *testing.T) {
+	c := Counters{Services: []string{"net *"}}
+	tracker := newCounterTracker()
+	now := time.Now()
+
+	ev := raidman.Event{Host: "h", Service: "net bytes", Metric: 1000}
+	AssertEqual(m, c.Rate(tracker, &ev, now), false)
+
+	ev = raidman.Event{Host: "h", Service: "net bytes", Metric: 3000}
+	AssertEqual(m, c.Rate(tracker, &ev, now.Add(10*time.Second)), true)
+	AssertEqual(m, ev.Metric, 200.0)
+
+	// not a counter
+	ev = raidman.Event{Host: "h", Service: "load", Metric: 3}
+	AssertEqual(m, c.Rate(tracker, &ev, now), true)
+	AssertEqual(m, ev.Metric, 3)
+
+	// per host
+	ev = raidman.Event{Host: "other", Service: "net bytes", Metric: 5000}
+	AssertEqual(m, c.Rate(tracker, &ev, now.Add(10*time.Second)), false)
+}
+
+func TestCountersResetAndWrap(m *testing.T) {
+	c := Counters{Services: []string{"*"}}
+	tracker := newCounterTracker()
+	now := time.Now()
+
+	sample := func(value float64, seconds int) (float64, bool) {
+		ev := raidman.Event{Service: "c", Metric: value}
+		ok := c.Rate(tracker, &ev, now.Add(time.Duration(seconds)*time.Second))
+		res, _ := metricValue(&ev)
+		return res, ok
+	}
+
+	sample(100, 0)
+	_, ok := sample(50, 1)
+	AssertEqual(m, ok, false)
+	rate, ok := sample(60, 2)
+	AssertEqual(m, ok, true)
+	AssertEqual(m, rate, 10.0)
+
+	c.Wrap = 255
+	sample(250, 3)
+	rate, ok = sample(4, 4)
+	AssertEqual(m, ok, true)
+	AssertEqual(m, rate, 10.0)
+
+	// too big to be a wrap
+	sample(100, 5)
+	_, ok = sample(10, 6)
+	AssertEqual(m, ok, false)
+}
@@ -1,76 +1,85 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
-	"os"
-	"os/exec"
 	"path/filepath"
-	"strconv"
 	"strings"
-	"time"
+	"text/template"
 
-	"github.com/amir/raidman"
+	"github.com/robfig/cron/v3"
 
+	"github.com/avalente/riemann-agent/cfgfile"
 	"github.com/avalente/riemann-agent/modules"
 )
 
 type Driver struct {
+	// the file name (followed by "#target" for targets), set when loading
 	Id            string
 	Description   string
 	Module        string
-	ModuleObject  modules.Module
+	ModuleObject  modules.Module `json:"-"`
 	Interval      int
+	Splay         bool
+	Jitter        int
+	Cron          string
+	Align         bool
+	RunOnStart    bool
 	Host          string
 	Service       string
 	Tags          []string
+	Attributes    map[string]string
+	State         string
+	Thresholds    Thresholds
+	Counters      Counters
+	Processors    []ProcessorConfig
+	Aggregation   Aggregation
+	Flapping      Flapping
+	OnChange      OnChange
+	MergePolicy   string
 	Ttl           float32
 	Configuration map[string]interface{}
-	doneChan      chan bool
+	// expanded into a driver per target, see expandTargets
+	Targets   []interface{}
+	Inventory string
+	alerter   *Alerter
+
+	fieldTemplates     map[string]*template.Template
+	attributeTemplates map[string]*template.Template
+	counterTracker     *counterTracker
+	processors         []Processor
+	cronSchedule       cron.Schedule
+	aggregationWindow  *aggregationWindow
+	flapTracker        *flapTracker
+	changeTracker      *changeTracker
+	params             modules.ModuleParamList
+	runner             driverRunner
+	hash               string
+	// the inventory of the targets, if any
+	inventory string
 }
 
-func StopDrivers(drivers []*Driver) {
-	for _, driver := range drivers {
-		driver.doneChan <- true
-	}
-}
-
-func StartDrivers(drivers []*Driver, queue ResQueue) {
-	for _, driver := range drivers {
-		driver.doneChan = make(chan bool)
-		go RunDriver(*driver, driver.doneChan, queue)
-	}
-}
-
-func ValidateType(name string, expType string, value interface{}) *string {
-	var vtype string
-
-	if value == nil {
-		return nil
-	}
-
-	switch t := value.(type) {
-	case bool:
-		vtype = "bool"
-	case int, int64, float64, float32:
-		vtype = "number"
-	case string:
-		vtype = "string"
-	case map[string]interface{}:
-		vtype = "map"
-	default:
-		res := fmt.Sprintf("%s (unsupported type %T)", name, t)
-		return &res
-	}
+// How the tags and attributes set by the module are combined with the
+// driver ones
+const (
+	// union of tags and attributes, the driver ones win on conflicts
+	MergePolicyMerge = "merge"
+	// union of tags and attributes, the module ones win on conflicts
+	MergePolicyKeep = "keep"
+	// the driver tags and attributes replace the module ones
+	MergePolicyReplace = "replace"
+)
 
-	if vtype != expType {
-		res := fmt.Sprintf("%s (%s not %s)", name, vtype, expType)
+// ValidateType checks the value of the parameter against its type and
+// constraints
+func ValidateType(param modules.ModuleParameter, value interface{}) *string {
+	err := param.Validate(value)
+	if err != nil {
+		res := fmt.Sprintf("%s (%v)", param.Name, err)
 		return &res
 	}
-
 	return nil
 }
 
@@ -90,7 +99,7 @@ func GetParameters(drv Driver) (modules.ModuleParamList, string) {
 			}
 		}
 
-		validationError := ValidateType(param.Name, param.Type, value)
+		validationError := ValidateType(param, value)
 		if validationError == nil {
 			params[param.Name] = value
 		} else {
@@ -117,214 +126,303 @@ func GetParameters(drv Driver) (modules.ModuleParamList, string) {
 	return params, err
 }
 
-func RunDriver(drv Driver, doneChan chan bool, queue ResQueue) {
-	switch drv.ModuleObject.Kind {
-	case "builtin":
-		RunBuiltin(&drv, &doneChan, &queue)
-	case "executable":
-		RunExecutable(&drv, &doneChan, &queue)
+// Start prepares the driver to run: the parameters are checked and the
+// module process, if any, is started
+func (drv *Driver) Start() error {
+	params, paramsErr := GetParameters(*drv)
+	if paramsErr != "" {
+		return fmt.Errorf("%s", paramsErr)
 	}
-}
 
-func readInt(reader io.Reader) int64 {
-	// string representation of four-digit integer (0001-9999)
-	//TODO:: check errors
-	countBuf := make([]byte, 4)
-	n, _ := reader.Read(countBuf)
-	if n != 4 {
+	runner, err := newRunner(drv, params)
+	if err != nil {
+		return err
 	}
-	count, _ := strconv.ParseInt(string(countBuf), 10, 0)
-	return count
-}
 
-func RunExecutable(pdrv *Driver, pdoneChan *chan bool, pqueue *ResQueue) {
-	drv := *pdrv
-	doneChan := *pdoneChan
-	queue := *pqueue
+	err = runner.Start()
+	if err != nil {
+		return err
+	}
 
-	paramsMap, err := GetParameters(drv)
-	if err != "" {
-		log.Error("Can't run driver %s: %s - DRIVER DISABLED", drv.Id, err)
-		<-doneChan
-	} else {
-		paramsJson, _ := json.Marshal(paramsMap)
+	drv.params = params
+	drv.runner = runner
 
-		duration := time.Duration(drv.Interval) * time.Second
+	return nil
+}
 
-		ticker := time.NewTicker(duration)
+// Run executes the module once and enqueues the resulting events
+func (drv *Driver) Run(queue ResQueue) error {
+	events, err := drv.Collect()
+	if err != nil {
+		return err
+	}
 
-		// start external process
-		cmd := exec.Command(drv.ModuleObject.Executable)
-		stdin, err_stdin := cmd.StdinPipe()
-		stdout, err_stdout := cmd.StdoutPipe()
+	drv.emit(events, queue)
 
-		switch {
-		case err_stdin != nil:
-			log.Error("Can't run driver %s on custom module %s: can't get stdin (%v) - DRIVER DISABLED", drv.Id, drv.Module, err_stdin)
-			<-doneChan
+	return nil
+}
 
-		case err_stdout != nil:
-			log.Error("Can't run driver %s on custom module %s: can't get stdout (%v) - DRIVER DISABLED", drv.Id, drv.Module, err_stdout)
-			<-doneChan
-		}
+// Collect executes the module once and returns the processed events
+func (drv *Driver) Collect() (modules.EventList, error) {
+	events, err := drv.runner.Run()
+	if err != nil {
+		return nil, err
+	}
 
-		err := cmd.Start()
-		if err != nil {
-			log.Error("Can't run driver %s on custom module %s: %s - DRIVER DISABLED", drv.Id, drv.Module, err)
-			<-doneChan
-		} else {
+	return drv.processEvents(events, drv.params), nil
+}
 
-		loop:
-			for true {
-				select {
-				case <-doneChan:
-					log.Debug("Terminating driver %v", drv.Id)
-					ticker.Stop()
-					stdin.Write([]byte("exit"))
-					cmd.Wait()
-					break loop
-				case <-ticker.C:
-					//TODO: check errors
-					in_ := append([]byte("call "), paramsJson...)
-					in_ = append(in_, '\n')
-					stdin.Write(in_)
-
-					count := readInt(stdout)
-
-					for i := 0; i < int(count); i++ {
-						size := readInt(stdout)
-						buf := make([]byte, size)
-						n, _ := stdout.Read(buf)
-						if n != int(size) {
-							//TODO: check n and errors
-						}
-
-						ev := raidman.Event{}
-						ev.Description = drv.Description
-						ev.Host = drv.Host
-						ev.Tags = drv.Tags
-						ev.Ttl = drv.Ttl
-						ev.Time = time.Now().Unix()
-
-						decoder := json.NewDecoder(bytes.NewReader(buf))
-						err := decoder.Decode(&ev)
-						if err != nil {
-							log.Error("Can't run driver %s on custom module %s: %s - DRIVER DISABLED", drv.Id, drv.Module, err)
-							<-doneChan
-							break
-						} else {
-							ev.Service = strings.Replace(drv.Service, "%tag", ev.Service, -1)
-							queue <- &ev
-						}
-					}
-				}
-			}
-		}
+// Stop terminates the module process, if any
+func (drv *Driver) Stop() {
+	if drv.runner != nil {
+		log.Debug("Terminating driver %v", drv.Id)
+		drv.runner.Stop()
+		drv.runner = nil
 	}
 }
 
-func RunBuiltin(pdrv *Driver, pdoneChan *chan bool, pqueue *ResQueue) {
-	drv := *pdrv
-	doneChan := *pdoneChan
-	queue := *pqueue
-
-	paramsMap, err := GetParameters(drv)
-	if err != "" {
-		log.Error("Can't run driver %s: %s - DRIVER DISABLED", drv.Id, err)
-		<-doneChan
-	} else {
-		duration := time.Duration(drv.Interval) * time.Second
-
-		ticker := time.NewTicker(duration)
-
-	loop:
-		for true {
-			select {
-			case <-ticker.C:
-				for _, ev := range drv.ModuleObject.Callable(paramsMap) {
-					ev.Description = drv.Description
-					ev.Service = strings.Replace(drv.Service, "%tag", ev.Service, -1)
-					ev.Host = drv.Host
-					ev.Tags = drv.Tags
-					ev.Ttl = drv.Ttl
-					ev.Time = time.Now().Unix()
-					queue <- ev
-				}
-			case <-doneChan:
-				log.Debug("Terminating driver %v", drv.Id)
-				ticker.Stop()
-				break loop
-			}
-		}
-	}
+// GetDrivers loads the drivers, logging and skipping the invalid ones
+func GetDrivers(availableModules map[string]modules.Module, cfg *Configuration) []*Driver {
+	drivers, _ := ReadDrivers(availableModules, cfg)
+	return drivers
 }
 
-func GetDrivers(availableModules map[string]modules.Module, directory string) []*Driver {
-	log.Debug("Getting drivers from %v", directory)
+// ReadDrivers loads the drivers, returning also the errors of the invalid
+// ones
+func ReadDrivers(availableModules map[string]modules.Module, cfg *Configuration) ([]*Driver, []error) {
+	directory := cfg.DriversDirectory
 
-	var err error
+	log.Debug("Getting drivers from %v", directory)
 
 	files, err := ioutil.ReadDir(directory)
 	if err != nil {
 		log.Critical("Can't read drivers: %v\n", err)
-		return []*Driver{}
+		return []*Driver{}, []error{err}
 	}
 
 	drivers := []*Driver{}
+	errs := []error{}
 
 	for _, entry := range files {
-		if !entry.IsDir() && filepath.Ext(entry.Name()) == ".json" {
+		if !entry.IsDir() && cfgfile.IsConfigFile(entry.Name()) {
 			name := entry.Name()
 			fullName := filepath.Join(directory, name)
 
 			log.Debug("Loading driver %s", name)
 
-			doLog := func(reason interface{}) {
-				log.Warning("Can't load driver <%v>: %v", fullName, reason)
+			fileDrivers, err := ReadDriver(fullName, availableModules, cfg)
+			if err != nil {
+				log.Warning("Can't load driver <%v>: %v", fullName, err)
+				errs = append(errs, fmt.Errorf("can't load driver <%v>: %v", fullName, err))
+				continue
 			}
 
-			file, err := os.Open(fullName)
-			if err != nil {
-				doLog(err)
-			} else {
-				defer file.Close()
-
-				decoder := json.NewDecoder(file)
-				drv := Driver{Interval: 30, Ttl: 60}
-				err = decoder.Decode(&drv)
-				if err != nil {
-					doLog(err)
-				} else {
-					if drv.Description == "" {
-						doLog("missing description")
-						continue
-					}
-
-					if drv.Module == "" {
-						doLog("missing module")
-						continue
-					}
-
-					mod, found := availableModules[drv.Module]
-					if !found {
-						doLog(fmt.Sprintf("unknown module: %v", drv.Module))
-						continue
-					} else {
-						drv.ModuleObject = mod
-					}
-
-					// override in case the attribute "id" was in the json file
-					drv.Id = fullName
-
-					// some default values
-					if drv.Service == "" {
-						drv.Service = drv.Description
-					}
-					drivers = append(drivers, &drv)
-				}
+			drivers = append(drivers, fileDrivers...)
+		}
+	}
+
+	return drivers, errs
+}
+
+// ReadDriver loads the drivers defined in the given file: one, or one per
+// target if the file declares targets. Lists of targets (inventories kept
+// among the drivers) define no driver.
+func ReadDriver(fileName string, availableModules map[string]modules.Module, cfg *Configuration) ([]*Driver, error) {
+	doc, err := cfgfile.Read(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	err = doc.Interpolate()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, isList := doc.Tree.([]interface{}); isList {
+		log.Debug("Skipping %s: list of targets", fileName)
+		return []*Driver{}, nil
+	}
+
+	targets, err := expandTargets(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	drivers := []*Driver{}
+
+	for _, target := range targets {
+		drv, err := NewDriver(target.doc, availableModules, cfg)
+		if err != nil {
+			if target.name != "" {
+				return nil, fmt.Errorf("target %s: %v", target.name, err)
 			}
+			return nil, err
+		}
+
+		if target.name != "" {
+			drv.Id = fileName + "#" + target.name
 		}
+		drv.inventory = target.inventory
+
+		drivers = append(drivers, drv)
 	}
 
-	return drivers
+	return drivers, nil
+}
+
+// snake_case spellings accepted for some driver keys
+var driverKeyAliases = map[string]string{
+	"run_on_start": "RunOnStart",
+	"on_change":    "OnChange",
+}
+
+// resolveAliases returns a copy of the document with the aliases replaced
+// by the field names
+func resolveAliases(doc *cfgfile.Document) (*cfgfile.Document, error) {
+	tree, ok := doc.Tree.(map[string]interface{})
+	if !ok {
+		return doc, nil
+	}
+
+	res := make(map[string]interface{}, len(tree))
+	for key, value := range tree {
+		res[key] = value
+	}
+
+	for alias, name := range driverKeyAliases {
+		key, found := lookupKey(res, alias)
+		if !found {
+			continue
+		}
+		if other, found := lookupKey(res, name); found {
+			return nil, doc.Errorf([]string{key}, "%s and %s are the same key", key, other)
+		}
+		res[name] = res[key]
+		delete(res, key)
+	}
+
+	resolved := *doc
+	resolved.Tree = res
+	return &resolved, nil
+}
+
+// NewDriver builds the driver defined in the given document, applying the
+// defaults and checking every option
+func NewDriver(doc *cfgfile.Document, availableModules map[string]modules.Module, cfg *Configuration) (*Driver, error) {
+	defaults := cfg.Defaults
+
+	doc, err := resolveAliases(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	drv := Driver{Interval: defaults.Interval, Ttl: defaults.Ttl, Host: defaults.Host,
+		Splay: defaults.Splay, Jitter: defaults.Jitter}
+	err = doc.DecodeStrict(&drv)
+	if err != nil {
+		return nil, err
+	}
+
+	if drv.Description == "" {
+		return nil, errors.New("missing description")
+	}
+
+	if drv.Module == "" {
+		return nil, errors.New("missing module")
+	}
+
+	if drv.Interval <= 0 {
+		return nil, doc.Errorf([]string{"Interval"}, "bad interval: %d", drv.Interval)
+	}
+
+	if drv.Jitter < 0 {
+		return nil, doc.Errorf([]string{"Jitter"}, "bad jitter: %d", drv.Jitter)
+	}
+
+	if drv.Jitter >= drv.Interval {
+		log.Warning("Driver %s: jitter (%d) reduced below the interval (%d)", doc.File, drv.Jitter, drv.Interval)
+		drv.Jitter = drv.Interval - 1
+	}
+
+	err = drv.compileSchedule()
+	if err != nil {
+		return nil, doc.Errorf([]string{"Cron"}, "%v", err)
+	}
+
+	mod, found := availableModules[drv.Module]
+	if !found {
+		return nil, doc.Errorf([]string{"Module"}, "unknown module: %v", drv.Module)
+	}
+	drv.ModuleObject = mod
+
+	// override in case the attribute "id" was in the file
+	drv.Id = doc.File
+
+	// some default values
+	if drv.Service == "" {
+		drv.Service = drv.Description
+	}
+
+	if drv.Host == "" {
+		drv.Host = defaults.Host
+	}
+
+	drv.Tags = mergeTags(defaults.Tags, drv.Tags)
+	drv.Attributes = mergeAttributes(defaults.Attributes, drv.Attributes)
+
+	switch drv.MergePolicy {
+	case "":
+		drv.MergePolicy = MergePolicyMerge
+	case MergePolicyMerge, MergePolicyKeep, MergePolicyReplace:
+	default:
+		return nil, doc.Errorf([]string{"MergePolicy"}, "bad merge policy: %v", drv.MergePolicy)
+	}
+
+	err = drv.Thresholds.Validate()
+	if err != nil {
+		return nil, doc.Errorf([]string{"Thresholds"}, "%v", err)
+	}
+
+	err = drv.Counters.Validate()
+	if err != nil {
+		return nil, doc.Errorf([]string{"Counters"}, "%v", err)
+	}
+	drv.counterTracker = newCounterTracker()
+
+	drv.processors, err = NewProcessors(drv.Processors)
+	if err != nil {
+		return nil, doc.Errorf([]string{"Processors"}, "%v", err)
+	}
+
+	err = drv.Aggregation.Validate()
+	if err != nil {
+		return nil, doc.Errorf([]string{"Aggregation"}, "%v", err)
+	}
+	drv.aggregationWindow = newAggregationWindow()
+
+	err = drv.Flapping.Validate()
+	if err != nil {
+		return nil, doc.Errorf([]string{"Flapping"}, "%v", err)
+	}
+	drv.flapTracker = newFlapTracker()
+
+	err = drv.OnChange.Validate(drv.Ttl)
+	if err != nil {
+		return nil, doc.Errorf([]string{"OnChange"}, "%v", err)
+	}
+	drv.changeTracker = newChangeTracker()
+
+	err = drv.compileTemplates()
+	if err != nil {
+		return nil, &cfgfile.FileError{File: doc.File, Err: err}
+	}
+
+	// the tree, after interpolation and targets expansion
+	tree, err := json.Marshal(doc.Tree)
+	if err != nil {
+		return nil, err
+	}
+	drv.hash = driverHash(tree, defaults, mod)
+
+	return &drv, nil
 }
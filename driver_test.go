@@ -0,0 +1,248 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/amir/raidman"
+
+	"github.com/avalente/riemann-agent/modules"
+)
+
+func createDriversDir(m *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir(ctx.dir, "drivers")
+	if err != nil {
+		m.Fatal(err)
+	}
+
+	for name, content := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			m.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+func testConfiguration(driversDir string) *Configuration {
+	cfg := NewConfiguration()
+	cfg.DriversDirectory = driversDir
+	cfg.Defaults.Host = "agent-host"
+	return cfg
+}
+
+func testModules() map[string]modules.Module {
+	return modules.ScanModules(filepath.Join(os.TempDir(), "non-existing-modules"))
+}
+
+func TestGetDriversFormats(m *testing.T) {
+	dir := createDriversDir(m, map[string]string{
+		"a.json": `{"description": "a", "module": "ping", "configuration": {"target": "localhost"}}`,
+		"b.yaml": "description: b\nmodule: ping\nconfiguration:\n  target: localhost\n",
+		"c.toml": "description = \"c\"\nmodule = \"ping\"\n[configuration]\ntarget = \"localhost\"\n",
+		"d.txt":  "ignored",
+		"e.yml":  "description: e\nmodule: unknown\n",
+		"f.json": `{"description": "f", "module": "ping", "interval": "x"}`,
+	})
+
+	drivers := GetDrivers(testModules(), testConfiguration(dir))
+
+	AssertEqual(m, len(drivers), 3)
+}
+
+func TestGetDriversDefaults(m *testing.T) {
+	dir := createDriversDir(m, map[string]string{
+		"a.yaml": "description: a\nmodule: ping\ntags: [ping, agent]\nattributes: {role: db}\n",
+		"b.yaml": "description: b\nmodule: ping\nhost: other\nttl: 10\ninterval: 5\n",
+	})
+
+	cfg := testConfiguration(dir)
+	cfg.Defaults.Tags = []string{"agent"}
+	cfg.Defaults.Attributes = map[string]string{"dc": "eu1", "role": "any"}
+
+	drivers := GetDrivers(testModules(), cfg)
+	if len(drivers) != 2 {
+		m.Fatalf("2 drivers expected, %d found", len(drivers))
+	}
+
+	a, b := drivers[0], drivers[1]
+
+	AssertEqual(m, a.Host, "agent-host")
+	AssertEqual(m, a.Interval, 30)
+	AssertEqual(m, a.Ttl, float32(60))
+	AssertEqual(m, len(a.Tags), 2)
+	AssertEqual(m, a.Tags[0], "agent")
+	AssertEqual(m, a.Tags[1], "ping")
+	AssertEqual(m, a.Attributes["dc"], "eu1")
+	AssertEqual(m, a.Attributes["role"], "db")
+
+	AssertEqual(m, b.Host, "other")
+	AssertEqual(m, b.Interval, 5)
+	AssertEqual(m, b.Ttl, float32(10))
+	AssertEqual(m, b.Tags[0], "agent")
+}
+
+func TestDriverAttributesTemplates(m *testing.T) {
+	drv := Driver{
+		Id:            "test",
+		Attributes:    map[string]string{"target": "{{.Params.url}}", "code": "http-{{.Attributes.code}}", "static": "value"},
+		Configuration: map[string]interface{}{"url": "http://localhost"},
+		MergePolicy:   MergePolicyMerge,
+	}
+
+	if err := drv.compileTemplates(); err != nil {
+		m.Fatal(err)
+	}
+
+	ev := raidman.Event{Attributes: map[string]string{"code": "200"}}
+	drv.completeEvent(&ev, modules.ModuleParamList(drv.Configuration))
+
+	AssertEqual(m, ev.Attributes["target"], "http://localhost")
+	AssertEqual(m, ev.Attributes["code"], "http-200")
+	AssertEqual(m, ev.Attributes["static"], "value")
+}
+
+func TestDriverBadAttributesTemplate(m *testing.T) {
+	for _, value := range []string{"{{.Params.url", "{{.Unknown}}"} {
+		drv := Driver{Attributes: map[string]string{"a": value}}
+		if drv.compileTemplates() == nil {
+			m.Errorf("error expected for template %s", value)
+		}
+	}
+}
+
+func TestDriverMergePolicies(m *testing.T) {
+	newEvent := func() *raidman.Event {
+		return &raidman.Event{Tags: []string{"module"}, Attributes: map[string]string{"a": "module", "b": "module"}}
+	}
+
+	drv := Driver{Tags: []string{"driver"}, Attributes: map[string]string{"a": "driver"}}
+	drv.compileTemplates()
+
+	drv.MergePolicy = MergePolicyMerge
+	ev := newEvent()
+	drv.completeEvent(ev, nil)
+	AssertEqual(m, len(ev.Tags), 2)
+	AssertEqual(m, ev.Attributes["a"], "driver")
+	AssertEqual(m, ev.Attributes["b"], "module")
+
+	drv.MergePolicy = MergePolicyKeep
+	ev = newEvent()
+	drv.completeEvent(ev, nil)
+	AssertEqual(m, len(ev.Tags), 2)
+	AssertEqual(m, ev.Attributes["a"], "module")
+	AssertEqual(m, ev.Attributes["b"], "module")
+
+	drv.MergePolicy = MergePolicyReplace
+	ev = newEvent()
+	drv.completeEvent(ev, nil)
+	AssertEqual(m, len(ev.Tags), 1)
+	AssertEqual(m, ev.Tags[0], "driver")
+	AssertEqual(m, ev.Attributes["a"], "driver")
+	AssertEqual(m, ev.Attributes["b"], "")
+}
+
+func TestGetDriversRejectsBadMergePolicy(m *testing.T) {
+	dir := createDriversDir(m, map[string]string{
+		"a.yaml": "description: a\nmodule: ping\nmergepolicy: other\n",
+		"b.yaml": "description: b\nmodule: ping\nattributes: {x: '{{.Nope}}'}\n",
+	})
+
+	drivers := GetDrivers(testModules(), testConfiguration(dir))
+
+	AssertEqual(m, len(drivers), 0)
+}
+
+func TestDriverFieldTemplates(m *testing.T) {
+	drv := Driver{
+		Id:            "test",
+		Description:   "{{.Event.Description}} on {{.Params.url}}",
+		Service:       "http {{.Attributes.code}} %tag",
+		Host:          "{{.Hostname}}",
+		State:         `{{if gt (float .Event.Metric) 1.0}}critical{{else}}ok{{end}}`,
+		Configuration: map[string]interface{}{"url": "http://localhost"},
+	}
+
+	if err := drv.compileTemplates(); err != nil {
+		m.Fatal(err)
+	}
+
+	ev := raidman.Event{Service: "get", Description: "check", Metric: 2, Attributes: map[string]string{"code": "200"}}
+	drv.completeEvent(&ev, modules.ModuleParamList(drv.Configuration))
+
+	AssertEqual(m, ev.Description, "check on http://localhost")
+	AssertEqual(m, ev.Service, "http 200 get")
+	AssertEqual(m, ev.Host, agentHostname())
+	AssertEqual(m, ev.State, "critical")
+
+	ev = raidman.Event{Metric: 0.5}
+	drv.completeEvent(&ev, modules.ModuleParamList(drv.Configuration))
+	AssertEqual(m, ev.State, "ok")
+}
+
+func TestDriverPlainFields(m *testing.T) {
+	drv := Driver{Description: "driver", Service: "svc %tag", Host: "host", State: "ok", Ttl: 30}
+	drv.compileTemplates()
+
+	ev := raidman.Event{Service: "a"}
+	drv.completeEvent(&ev, nil)
+
+	AssertEqual(m, ev.Service, "svc a")
+	AssertEqual(m, ev.Description, "driver")
+	AssertEqual(m, ev.Host, "host")
+	AssertEqual(m, ev.State, "ok")
+	AssertEqual(m, ev.Ttl, float32(30))
+
+	ev = raidman.Event{Description: "module", Host: "other", State: "failure"}
+	drv.completeEvent(&ev, nil)
+
+	AssertEqual(m, ev.Description, "module")
+	AssertEqual(m, ev.Host, "other")
+	AssertEqual(m, ev.State, "failure")
+}
+
+func TestReadDriversErrors(m *testing.T) {
+	dir := createDriversDir(m, map[string]string{
+		"a.yaml": "description: a\nmodule: ping\n",
+		"b.yaml": "description: b\nmodule: unknown\n",
+		"c.json": `{"description": "c"`,
+	})
+
+	drivers, errs := ReadDrivers(testModules(), testConfiguration(dir))
+
+	AssertEqual(m, len(drivers), 1)
+	AssertEqual(m, len(errs), 2)
+}
+
+func TestNormalizeMetric(m *testing.T) {
+	ev := raidman.Event{Service: "s", Metric: "12.5"}
+	AssertEqual(m, normalizeMetric(&ev), nil)
+	AssertEqual(m, ev.Metric, 12.5)
+
+	ev = raidman.Event{Service: "s", Metric: int32(3)}
+	AssertEqual(m, normalizeMetric(&ev), nil)
+	AssertEqual(m, ev.Metric, 3.0)
+
+	ev = raidman.Event{Service: "s", Metric: int64(3)}
+	AssertEqual(m, normalizeMetric(&ev), nil)
+	AssertEqual(m, ev.Metric, int64(3))
+
+	ev = raidman.Event{Service: "s", Metric: "abc"}
+	if normalizeMetric(&ev) == nil {
+		m.Errorf("error expected for metric %v", ev.Metric)
+	}
+}
+
+func TestSendErrors(m *testing.T) {
+	err := (&raidman.Client{}).Send(&raidman.Event{Service: "s", Metric: "abc"})
+	AssertEqual(m, isConnectionError(err), false)
+
+	_, err = net.Dial("unix", filepath.Join(ctx.dir, "missing.sock"))
+	AssertEqual(m, isConnectionError(err), true)
+	AssertEqual(m, isConnectionError(io.EOF), true)
+}
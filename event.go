@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/amir/raidman"
+
+	"github.com/avalente/riemann-agent/modules"
+)
+
+// Driver fields that can be templates
+var templateFields = []string{"Service", "Description", "Host", "State"}
+
+func (drv *Driver) fieldValue(field string) string {
+	switch field {
+	case "Service":
+		return drv.Service
+	case "Description":
+		return drv.Description
+	case "Host":
+		return drv.Host
+	case "State":
+		return drv.State
+	}
+	return ""
+}
+
+// compileTemplates parses and checks the driver templates
+func (drv *Driver) compileTemplates() error {
+	drv.fieldTemplates = map[string]*template.Template{}
+	drv.attributeTemplates = map[string]*template.Template{}
+
+	for _, field := range templateFields {
+		tmpl, err := compileTemplate(field, drv.fieldValue(field))
+		if err == nil && tmpl != nil {
+			err = checkTemplate(tmpl, drv)
+		}
+		if err != nil {
+			return fmt.Errorf("bad template for %s: %v", strings.ToLower(field), err)
+		}
+		if tmpl != nil {
+			drv.fieldTemplates[field] = tmpl
+		}
+	}
+
+	for key, value := range drv.Attributes {
+		tmpl, err := compileTemplate(key, value)
+		if err == nil && tmpl != nil {
+			err = checkTemplate(tmpl, drv)
+		}
+		if err != nil {
+			return fmt.Errorf("bad template for attribute %s: %v", key, err)
+		}
+		if tmpl != nil {
+			drv.attributeTemplates[key] = tmpl
+		}
+	}
+
+	return nil
+}
+
+// renderField renders a templated driver field; it returns false if the
+// field is not a template or it can't be rendered
+func (drv *Driver) renderField(field string, data *templateData) (string, bool) {
+	tmpl, found := drv.fieldTemplates[field]
+	if !found {
+		return "", false
+	}
+
+	value, err := renderTemplate(tmpl, data)
+	if err != nil {
+		log.Warning("Driver %s: can't render %s: %v", drv.Id, strings.ToLower(field), err)
+		return "", false
+	}
+	return value, true
+}
+
+// applyField sets an event field from a templated driver field, or from
+// the plain driver field if the module didn't set it
+func (drv *Driver) applyField(field string, data *templateData, value *string) {
+	if _, found := drv.fieldTemplates[field]; found {
+		if rendered, ok := drv.renderField(field, data); ok {
+			*value = rendered
+		}
+	} else if *value == "" {
+		*value = drv.fieldValue(field)
+	}
+}
+
+// renderAttributes returns the driver attributes for the given event
+func (drv *Driver) renderAttributes(data *templateData) map[string]string {
+	attrs := make(map[string]string, len(drv.Attributes))
+
+	for key, value := range drv.Attributes {
+		tmpl, found := drv.attributeTemplates[key]
+		if found {
+			var err error
+			value, err = renderTemplate(tmpl, data)
+			if err != nil {
+				log.Warning("Driver %s: can't render attribute %s: %v", drv.Id, key, err)
+				continue
+			}
+		}
+		attrs[key] = value
+	}
+
+	return attrs
+}
+
+// completeEvent fills an event produced by the module with the driver
+// fields. Templates see the event as it was produced by the module; plain
+// description, host and state are used only if the module didn't set them.
+func (drv *Driver) completeEvent(ev *raidman.Event, params modules.ModuleParamList) {
+	produced := *ev
+	data := templateData{
+		Driver:     drv,
+		Params:     params,
+		Event:      &produced,
+		Attributes: produced.Attributes,
+		Hostname:   agentHostname(),
+	}
+	if data.Attributes == nil {
+		data.Attributes = map[string]string{}
+	}
+
+	// service: "%tag" is replaced by the service set by the module
+	service := drv.Service
+	if _, found := drv.fieldTemplates["Service"]; found {
+		service, _ = drv.renderField("Service", &data)
+		if service == "" {
+			service = drv.Description
+		}
+	}
+	ev.Service = strings.Replace(service, "%tag", produced.Service, -1)
+
+	drv.applyField("Description", &data, &ev.Description)
+	drv.applyField("Host", &data, &ev.Host)
+	drv.applyField("State", &data, &ev.State)
+
+	drv.mergeEventFields(ev, drv.renderAttributes(&data))
+
+	if ev.Ttl == 0 {
+		ev.Ttl = drv.Ttl
+	}
+	if ev.Time == 0 {
+		ev.Time = time.Now().Unix()
+	}
+}
+
+// mergeEventFields combines the tags and attributes of an event produced
+// by the module with the driver ones, according to the merge policy
+func (drv *Driver) mergeEventFields(ev *raidman.Event, attrs map[string]string) {
+	switch drv.MergePolicy {
+	case MergePolicyReplace:
+		ev.Tags = drv.Tags
+		ev.Attributes = attrs
+	case MergePolicyKeep:
+		ev.Tags = mergeTags(drv.Tags, ev.Tags)
+		ev.Attributes = mergeAttributes(attrs, ev.Attributes)
+	default:
+		ev.Tags = mergeTags(drv.Tags, ev.Tags)
+		ev.Attributes = mergeAttributes(ev.Attributes, attrs)
+	}
+}
+
+// mergeTags returns the union of the given tags, preserving their order
+func mergeTags(tags ...[]string) []string {
+	res := []string{}
+	seen := map[string]bool{}
+	for _, list := range tags {
+		for _, tag := range list {
+			if !seen[tag] {
+				seen[tag] = true
+				res = append(res, tag)
+			}
+		}
+	}
+	return res
+}
+
+// mergeAttributes returns a new map with the given attributes, the latter
+// overriding the former
+func mergeAttributes(attributes ...map[string]string) map[string]string {
+	res := map[string]string{}
+	for _, attrs := range attributes {
+		for k, v := range attrs {
+			res[k] = v
+		}
+	}
+	return res
+}
+
+// normalizeMetric makes sure the metric of the event can be encoded by
+// raidman (nil, integer or float): other numeric values, like the strings
+// decoded from the JSON of a custom module, are converted to float64
+func normalizeMetric(ev *raidman.Event) error {
+	switch ev.Metric.(type) {
+	case nil, int, int64, uint64, float32, float64:
+		return nil
+	}
+
+	value, ok := metricValue(ev)
+	if !ok {
+		return fmt.Errorf("bad metric %v for %s", ev.Metric, ev.Service)
+	}
+	ev.Metric = value
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/amir/raidman"
+)
+
+const FlappingState = "flapping"
+
+// Flapping configures the flap detection of a driver: the last Window
+// states of every service are kept and a weighted percentage of state
+// changes is computed, like Nagios does. When it goes over High a single
+// "flapping" event is sent and the following events are suppressed until
+// it goes under Low; the flapping event is repeated every half ttl so that
+// it doesn't expire in the meanwhile.
+type Flapping struct {
+	Enabled bool
+	Window  int
+	High    float64
+	Low     float64
+}
+
+func (f *Flapping) setDefaults() {
+	if f.Window == 0 {
+		f.Window = 21
+	}
+	if f.High == 0 {
+		f.High = 50
+	}
+	if f.Low == 0 {
+		f.Low = 25
+	}
+}
+
+func (f *Flapping) Validate() error {
+	if !f.Enabled {
+		return nil
+	}
+
+	f.setDefaults()
+
+	if f.Window < 3 {
+		return fmt.Errorf("bad flapping window: %v", f.Window)
+	}
+
+	if f.Low < 0 || f.High > 100 || f.Low > f.High {
+		return fmt.Errorf("bad flapping thresholds: low %v, high %v", f.Low, f.High)
+	}
+
+	return nil
+}
+
+// flapRatio returns the weighted percentage of state changes in the given
+// history (oldest first); recent changes weight more (1.2) than older
+// ones (0.8)
+func flapRatio(states []string) float64 {
+	n := len(states)
+	if n < 3 {
+		return 0
+	}
+
+	changes := 0.0
+	for i := 1; i < n; i++ {
+		if states[i] != states[i-1] {
+			changes += 0.8 + 0.4*float64(i-1)/float64(n-2)
+		}
+	}
+
+	return changes / float64(n-1) * 100
+}
+
+type flapHistory struct {
+	states   []string
+	flapping bool
+	lastSent time.Time
+}
+
+// flapTracker keeps the state history, by host and service
+type flapTracker struct {
+	sync.Mutex
+	history map[[2]string]*flapHistory
+}
+
+func newFlapTracker() *flapTracker {
+	return &flapTracker{history: map[[2]string]*flapHistory{}}
+}
+
+// Check records the state of the event and returns the event to be sent
+// instead of it, or nil if it must be suppressed
+func (f *Flapping) Check(tracker *flapTracker, ev *raidman.Event, now time.Time) *raidman.Event {
+	if !f.Enabled {
+		return ev
+	}
+
+	tracker.Lock()
+	defer tracker.Unlock()
+
+	key := [2]string{ev.Host, ev.Service}
+	h, found := tracker.history[key]
+	if !found {
+		h = &flapHistory{}
+		tracker.history[key] = h
+	}
+
+	h.states = append(h.states, ev.State)
+	if len(h.states) > f.Window {
+		h.states = h.states[len(h.states)-f.Window:]
+	}
+
+	if len(h.states) < f.Window {
+		return ev
+	}
+
+	ratio := flapRatio(h.states)
+	formatted := strconv.FormatFloat(ratio, 'f', 1, 64)
+
+	switch {
+	case !h.flapping && ratio > f.High:
+		log.Info("Service %s on %s is flapping (%s%%)", ev.Service, ev.Host, formatted)
+		h.flapping = true
+	case h.flapping && ratio < f.Low:
+		log.Info("Service %s on %s stopped flapping (%s%%)", ev.Service, ev.Host, formatted)
+		h.flapping = false
+		h.lastSent = time.Time{}
+		ev.Attributes = mergeAttributes(ev.Attributes, map[string]string{"flap_ratio": formatted})
+		return ev
+	case !h.flapping:
+		return ev
+	}
+
+	heartbeat := time.Duration(float64(ev.Ttl) / 2 * float64(time.Second))
+	if !h.lastSent.IsZero() && (heartbeat <= 0 || now.Sub(h.lastSent) < heartbeat) {
+		return nil
+	}
+	h.lastSent = now
+
+	flapping := *ev
+	flapping.State = FlappingState
+	flapping.Attributes = mergeAttributes(ev.Attributes, map[string]string{"flap_ratio": formatted})
+	return &flapping
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/amir/raidman"
+)
+
+func TestFlapRatio(m *testing.T) {
+	AssertEqual(m, flapRatio([]string{"ok", "ok", "ok", "ok"}), 0.0)
+	AssertEqual(m, flapRatio([]string{"ok", "critical", "ok", "critical", "ok"}), 100.0)
+
+	// recent changes weight more
+	older := flapRatio([]string{"ok", "critical", "critical", "critical", "critical"})
+	recent := flapRatio([]string{"ok", "ok", "ok", "ok", "critical"})
+	if older >= recent {
+		m.Errorf("%v >= %v", older, recent)
+	}
+}
+
+func TestFlappingDetection(m *testing.T) {
+	f := Flapping{Enabled: true, Window: 5}
+	if err := f.Validate(); err != nil {
+		m.Fatal(err)
+	}
+
+	tracker := newFlapTracker()
+	now := time.Now()
+	seconds := 0
+
+	check := func(state string) *raidman.Event {
+		seconds += 10
+		ev := raidman.Event{Service: "s", State: state, Ttl: 60}
+		return f.Check(tracker, &ev, now.Add(time.Duration(seconds)*time.Second))
+	}
+
+	// window not full yet
+	for _, state := range []string{"ok", "critical", "ok", "critical"} {
+		AssertEqual(m, check(state).State, state)
+	}
+
+	ev := check("ok")
+	AssertEqual(m, ev.State, FlappingState)
+	AssertEqual(m, ev.Attributes["flap_ratio"], "100.0")
+
+	// suppressed while flapping
+	if check("critical") != nil {
+		m.Error("event expected to be suppressed")
+	}
+
+	// flapping event repeated after half ttl
+	seconds += 30
+	AssertEqual(m, check("ok").State, FlappingState)
+
+	// settles
+	for i := 0; i < 2; i++ {
+		if check("ok") != nil {
+			m.Error("event expected to be suppressed")
+		}
+	}
+	ev = check("ok")
+	AssertEqual(m, ev.State, "ok")
+	AssertEqual(m, ev.Attributes["flap_ratio"], "20.0")
+
+	ev = check("ok")
+	AssertEqual(m, ev.State, "ok")
+	AssertEqual(m, ev.Attributes["flap_ratio"], "")
+}
+
+func TestFlappingValidation(m *testing.T) {
+	bad := []Flapping{
+		{Enabled: true, Window: 2},
+		{Enabled: true, High: 120},
+		{Enabled: true, Low: 60, High: 50},
+	}
+
+	for _, f := range bad {
+		if f.Validate() == nil {
+			m.Errorf("error expected for %+v", f)
+		}
+	}
+}
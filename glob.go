@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Glob is a shell-like pattern matching service names: "*" matches any
+// sequence of characters (including "/"), "?" any single character and
+// "[...]" a character class
+type Glob struct {
+	Pattern string
+	re      *regexp.Regexp
+}
+
+func CompileGlob(pattern string) (*Glob, error) {
+	var expr strings.Builder
+	expr.WriteString("^")
+
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			expr.WriteString(".*")
+		case '?':
+			expr.WriteString(".")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated character class in %s", pattern)
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	expr.WriteString("$")
+
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, fmt.Errorf("bad pattern %s: %v", pattern, err)
+	}
+	return &Glob{Pattern: pattern, re: re}, nil
+}
+
+func (g *Glob) Match(value string) bool {
+	return g.re.MatchString(value)
+}
+
+// compiled patterns, by pattern (nil if invalid)
+var globCache sync.Map
+
+// matchGlob matches value against a pattern, which is considered not
+// matching if invalid
+func matchGlob(pattern string, value string) bool {
+	cached, found := globCache.Load(pattern)
+	if !found {
+		glob, _ := CompileGlob(pattern)
+		cached, _ = globCache.LoadOrStore(pattern, glob)
+	}
+	glob := cached.(*Glob)
+	return glob != nil && glob.Match(value)
+}
@@ -1,17 +1,22 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"math"
+	"net"
 	"os"
 	"os/signal"
+	"reflect"
 	"syscall"
 	"time"
 
 	"github.com/amir/raidman"
 	"github.com/op/go-logging"
 
+	"github.com/avalente/riemann-agent/cfgfile"
 	"github.com/avalente/riemann-agent/modules"
 )
 
@@ -21,8 +26,16 @@ var log = logging.MustGetLogger(LOGGING_MODULE)
 
 var logFile *os.File
 
+// ReloadService is the service of the events reporting the outcome of the
+// configuration reloads
+const ReloadService = "riemann-agent reload"
+
 type ResQueue chan *raidman.Event
 
+// maxBackoff is the longest wait, in seconds, between two attempts to
+// connect to riemann
+const maxBackoff = 60
+
 type CmdlineArgs struct {
 	configFile string
 	verbose    bool
@@ -32,7 +45,10 @@ type CmdlineArgs struct {
 type AppState struct {
 	cmdLine       CmdlineArgs
 	resChannel    *ResQueue
-	drivers       *[]*Driver
+	scheduler     *Scheduler
+	alerter       *Alerter
+	watcher       *Watcher
+	socket        *SocketListener
 	configuration *Configuration
 	senderDone    *chan bool
 }
@@ -44,10 +60,35 @@ func parseCmdline() CmdlineArgs {
 	cfgfile := flag.String("c", "config.json", "Configuration file")
 	verbose := flag.Bool("v", false, "Verbose")
 	pidfile := flag.String("p", "<none>", "Pid file location")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [command] [options]\n\ncommands: %s\n\noptions:\n", os.Args[0], commandNames())
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 	return CmdlineArgs{*cfgfile, *verbose, *pidfile}
 }
 
+// redactingBackend masks the registered secrets in the log messages
+type redactingBackend struct {
+	backend logging.Backend
+}
+
+// redactedArg formats the wrapped value and masks the secrets in the result
+type redactedArg struct {
+	value interface{}
+}
+
+func (a redactedArg) Format(f fmt.State, verb rune) {
+	io.WriteString(f, cfgfile.Redact(fmt.Sprintf(fmt.FormatString(f, verb), a.value)))
+}
+
+func (b redactingBackend) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	for i, arg := range rec.Args {
+		rec.Args[i] = redactedArg{arg}
+	}
+	return b.backend.Log(level, calldepth+1, rec)
+}
+
 func initializeLogging(fileName string, stringLevel string) {
 	if logFile != nil {
 		logFile.Close()
@@ -62,26 +103,12 @@ func initializeLogging(fileName string, stringLevel string) {
 		level = logging.INFO
 	}
 
-	consoleLogging := func() {
-		formatter := logging.MustStringFormatter(
-			"%{color}[%{time:2006-01-02 15:04:05.000}] %{module} %{shortfile} ▶ %{level:-7.7s}%{color:reset} %{message}",
-		)
-		logging.SetFormatter(formatter)
-
-		backend := logging.NewLogBackend(os.Stdout, "", 0)
-
-		bl := logging.AddModuleLevel(backend)
-		bl.SetLevel(level, "")
-
-		logging.SetBackend(bl)
-	}
-
 	if fileName == "-" {
-		consoleLogging()
+		consoleLogging(os.Stdout, level)
 	} else {
 		file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 		if err != nil {
-			consoleLogging()
+			consoleLogging(os.Stdout, level)
 			log.Error("%v", err)
 		} else {
 			logFile = file
@@ -92,13 +119,28 @@ func initializeLogging(fileName string, stringLevel string) {
 			logging.SetFormatter(formatter)
 
 			backend := logging.NewLogBackend(file, "", 0)
-			bl := logging.AddModuleLevel(backend)
+			bl := logging.AddModuleLevel(redactingBackend{backend})
 			bl.SetLevel(level, "")
 			logging.SetBackend(bl)
 		}
 	}
 }
 
+// consoleLogging sends the log, colored, to the given stream
+func consoleLogging(out io.Writer, level logging.Level) {
+	formatter := logging.MustStringFormatter(
+		"%{color}[%{time:2006-01-02 15:04:05.000}] %{module} %{shortfile} ▶ %{level:-7.7s}%{color:reset} %{message}",
+	)
+	logging.SetFormatter(formatter)
+
+	backend := logging.NewLogBackend(out, "", 0)
+
+	bl := logging.AddModuleLevel(redactingBackend{backend})
+	bl.SetLevel(level, "")
+
+	logging.SetBackend(bl)
+}
+
 func createPidFile(file string) {
 	if file != "" {
 		file, err := os.Create(file)
@@ -113,34 +155,41 @@ func createPidFile(file string) {
 }
 
 func main() {
+	if code, found := runCommand(os.Args[1:]); found {
+		os.Exit(code)
+	}
+
 	// results channel
 	resChannel := make(ResQueue, 10000)
-	emptyDrivers := []*Driver{}
 
-	state := AppState{cmdLine: parseCmdline(), resChannel: &resChannel, drivers: &emptyDrivers}
+	state := AppState{cmdLine: parseCmdline(), resChannel: &resChannel}
 
 	// Wait for signal
 	sigc := make(chan os.Signal, 1)
 	signal.Notify(sigc, os.Interrupt, os.Kill, syscall.SIGHUP, syscall.SIGTERM)
 
+	start(&state)
+
 loop:
 	for true {
-		start(&state)
-
 		log.Info("Instance %v started.", os.Getpid())
 		createPidFile(state.configuration.PidFile)
 
-		// Block until a signal is received.
-		sig := <-sigc
-		switch sig {
-		case os.Interrupt, os.Kill, syscall.SIGTERM:
-			break loop
-		case syscall.SIGHUP:
-			log.Notice("Reloading...")
-			StopAll(&state)
-			continue
-		default:
-			log.Debug("Unhandled signal: %v", sig)
+		// Block until a signal is received or the files change.
+		select {
+		case sig := <-sigc:
+			switch sig {
+			case os.Interrupt, os.Kill, syscall.SIGTERM:
+				break loop
+			case syscall.SIGHUP:
+				log.Notice("Reloading...")
+				reload(&state)
+			default:
+				log.Debug("Unhandled signal: %v", sig)
+			}
+		case <-state.watcher.Reload():
+			log.Notice("Configuration changed, reloading...")
+			reload(&state)
 		}
 	}
 
@@ -156,20 +205,20 @@ loop:
 }
 
 func StopAll(state *AppState) {
+	state.watcher.Stop()
+	state.socket.Stop()
 	*state.senderDone <- true
-	StopDrivers(*state.drivers)
+	state.scheduler.Stop()
 }
 
-func start(state *AppState) {
-	// Read configuration from file
+// readConfiguration reads the configuration file, applying the command
+// line overrides
+func readConfiguration(state *AppState) (*Configuration, error) {
 	cfg, err := GetConfiguration(state.cmdLine.configFile)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Can't read configuration file: %v\n", err)
-		os.Exit(1)
+		return nil, err
 	}
 
-	state.configuration = cfg
-
 	// Override configurated pid file
 	if state.cmdLine.pidfile != "<none>" {
 		cfg.PidFile = state.cmdLine.pidfile
@@ -181,27 +230,198 @@ func start(state *AppState) {
 		cfg.LogLevel = "debug"
 	}
 
+	return cfg, nil
+}
+
+// loadConfiguration reads the configuration file and sets up the logging
+func loadConfiguration(state *AppState) *Configuration {
+	cfg, err := readConfiguration(state)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Can't read configuration file: %v\n", err)
+		os.Exit(1)
+	}
+
 	initializeLogging(cfg.LogFile, cfg.LogLevel)
 
-	// create the listener
+	return cfg
+}
+
+// loadDrivers loads the modules and the drivers, returning the errors of
+// both
+func loadDrivers(cfg *Configuration) ([]*Driver, []error) {
+	availableModules, _, errs := modules.ReadModules(cfg.ModulesDirectory)
+	log.Info("%v modules loaded", len(availableModules))
+
+	drivers, driverErrs := ReadDrivers(availableModules, cfg)
+	log.Info("%v drivers loaded", len(drivers))
+
+	return drivers, append(errs, driverErrs...)
+}
+
+func startSender(state *AppState) {
 	chn := make(chan bool)
 	state.senderDone = &chn
-	go riemannSender(cfg, state.resChannel, &chn)
+	go riemannSender(state.configuration, state.resChannel, &chn)
+}
+
+func startScheduler(state *AppState, drivers []*Driver) {
+	state.scheduler = NewScheduler(realClock{}, state.configuration, *state.resChannel, state.alerter)
+	for _, drv := range drivers {
+		state.scheduler.Add(drv)
+	}
+}
+
+func start(state *AppState) {
+	state.configuration = loadConfiguration(state)
+	setAgentHostname(state.configuration.Defaults.Host)
+
+	// create the listener
+	startSender(state)
 
 	// Start the drivers
-	availableModules := modules.ScanModules(cfg.ModulesDirectory)
-	log.Info("%v modules loaded", len(availableModules))
+	state.alerter = NewAlerter(state.configuration.Alerts)
+	drivers, _ := loadDrivers(state.configuration)
+	startScheduler(state, drivers)
 
-	newDrivers := GetDrivers(availableModules, cfg.DriversDirectory)
-	log.Info("%v drivers loaded", len(newDrivers))
+	startSocket(state)
+	startWatcher(state, drivers)
+}
+
+// startSocket (re)starts the listener of the send command, if configured
+func startSocket(state *AppState) {
+	state.socket.Stop()
+	state.socket = nil
+
+	cfg := state.configuration
+	if cfg.Socket == "" {
+		return
+	}
+
+	socket, err := NewSocketListener(cfg.Socket, *state.resChannel, cfg.Defaults, state.alerter)
+	if err != nil {
+		log.Error("Can't listen on %s: %v", cfg.Socket, err)
+		return
+	}
+	state.socket = socket
+}
+
+// startWatcher (re)starts the watcher on the current configuration and
+// the inventories of the drivers, if
+// requested
+func startWatcher(state *AppState, drivers []*Driver) {
+	state.watcher.Stop()
+	state.watcher = nil
+
+	cfg := state.configuration
+	if !cfg.Watch {
+		return
+	}
+
+	watcher, err := NewWatcher(cfg, state.cmdLine.configFile, inventoryDirs(drivers),
+		time.Duration(cfg.WatchDebounce)*time.Second)
+	if err != nil {
+		log.Error("Can't watch the configuration: %v", err)
+		return
+	}
+	state.watcher = watcher
+}
 
-	StartDrivers(newDrivers, *state.resChannel)
+// reload applies the new configuration only if it's valid, together with
+// all the modules and drivers; otherwise the running one is kept. The
+// outcome is logged and sent to riemann.
+func reload(state *AppState) {
+	err := tryReload(state)
+	if err != nil {
+		log.Error("Can't reload, keeping the running configuration: %v", err)
+		reportReload(state, "critical", fmt.Sprintf("reload failed: %v", err))
+	} else {
+		reportReload(state, "ok", "reload succeeded")
+	}
+}
+
+func tryReload(state *AppState) error {
+	cfg, err := readConfiguration(state)
+	if err != nil {
+		return err
+	}
+
+	drivers, errs := loadDrivers(cfg)
+	errs = append(errs, checkParameters(drivers)...)
+	if len(errs) > 0 {
+		return fmt.Errorf("%d errors, first: %v", len(errs), errs[0])
+	}
+
+	initializeLogging(cfg.LogFile, cfg.LogLevel)
+	applyConfiguration(state, cfg, drivers)
 
-	state.drivers = &newDrivers
+	return nil
 }
 
+// reportReload sends the outcome of the reload to riemann
+func reportReload(state *AppState, evState, description string) {
+	cfg := state.configuration
+
+	ev := &raidman.Event{
+		Host:        cfg.Defaults.Host,
+		Service:     ReloadService,
+		State:       evState,
+		Description: cfgfile.Redact(description),
+		Ttl:         cfg.Defaults.Ttl,
+		Time:        time.Now().Unix(),
+	}
+
+	select {
+	case *state.resChannel <- ev:
+	default:
+		log.Warning("Results queue full, reload event dropped")
+	}
+}
+
+// applyConfiguration applies the configuration changes, restarting only
+// what changed: the sender keeps its connection if the riemann settings
+// are the same and the unchanged drivers keep running with their state
+func applyConfiguration(state *AppState, cfg *Configuration, drivers []*Driver) {
+	old := state.configuration
+	state.configuration = cfg
+	setAgentHostname(cfg.Defaults.Host)
+	defer startWatcher(state, drivers)
+
+	if senderChanged(old, cfg) {
+		log.Notice("Riemann settings changed, reconnecting")
+		*state.senderDone <- true
+		startSender(state)
+	}
+
+	state.alerter.SetRules(cfg.Alerts)
+
+	if old.Socket != cfg.Socket || !reflect.DeepEqual(old.Defaults, cfg.Defaults) {
+		startSocket(state)
+	}
+
+	if schedulerChanged(old, cfg) {
+		log.Notice("Scheduler settings changed, restarting all the drivers")
+		state.scheduler.Stop()
+		startScheduler(state, drivers)
+		return
+	}
+
+	keep, stop, start := diffDrivers(state.scheduler.Drivers(), drivers)
+
+	for _, drv := range stop {
+		state.scheduler.Remove(drv)
+	}
+
+	for _, drv := range start {
+		state.scheduler.Add(drv)
+	}
+
+	log.Info("Drivers reloaded: %d unchanged, %d stopped, %d started", len(keep), len(stop), len(start))
+}
+
+// riemannConnect connects to riemann, retrying with an exponential backoff
+// (up to maxBackoff seconds) until it succeeds or the sender is stopped
 func riemannConnect(cfg *Configuration, done *chan bool) *raidman.Client {
-	for i := 0; i < 10; i++ {
+	for i := 0; ; i++ {
 		conn, err := raidman.Dial(cfg.RiemannProtocol, cfg.RiemannHost)
 
 		if err == nil {
@@ -209,7 +429,7 @@ func riemannConnect(cfg *Configuration, done *chan bool) *raidman.Client {
 			return conn
 		}
 
-		w := math.Pow(2, float64(i))
+		w := math.Min(math.Pow(2, float64(i)), maxBackoff)
 		log.Error("can't connect to riemann: %v - waiting %v seconds", err, w)
 		timerChan := time.After(time.Duration(w) * time.Second)
 
@@ -220,16 +440,25 @@ func riemannConnect(cfg *Configuration, done *chan bool) *raidman.Client {
 			continue
 		}
 	}
-	panic("Can't connect to riemann")
+}
+
+// isConnectionError returns true if the error comes from the connection to
+// riemann rather than from the event
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
 }
 
 func riemannSender(cfg *Configuration, channel *ResQueue, done *chan bool) {
 	conn := riemannConnect(cfg, done)
-	if conn != nil {
-		defer conn.Close()
-	} else {
+	if conn == nil {
 		return
 	}
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
 
 loop:
 	for true {
@@ -241,15 +470,27 @@ loop:
 			if message == nil {
 				break loop
 			}
-			err := conn.Send(message)
-			if err != nil {
+			if err := normalizeMetric(message); err != nil {
+				log.Error("Event dropped: %v", err)
+				continue
+			}
+			// the message is kept until sent: re-enqueueing it could block
+			// forever on a full queue. Only connection errors are retried,
+			// the events refused by riemann are dropped.
+			for {
+				err := conn.Send(message)
+				if err == nil {
+					break
+				}
+				if !isConnectionError(err) {
+					log.Error("Event %s dropped: %v", message.Service, err)
+					break
+				}
 				log.Error("Error during send: %v", err)
-				// re-enqueue the consumed message
-				*channel <- message
-				// reconnect
+				conn.Close()
 				conn = riemannConnect(cfg, done)
-				if conn != nil {
-					defer conn.Close()
+				if conn == nil {
+					break loop
 				}
 			}
 		}
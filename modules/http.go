@@ -11,15 +11,16 @@ import (
 )
 
 var HttpModule = Module{
-	"http", "builtin",
-	[]ModuleParameter{
-		ModuleParameter{"url", "string", true, nil},
-		ModuleParameter{"method", "string", false, "GET"},
-		ModuleParameter{"headers", "map", false, map[string]string{}},
-		ModuleParameter{"body", "string", false, nil},
-		ModuleParameter{"timeout", "number", false, 10},
-		ModuleParameter{"include_response", "bool", false, false}},
-	ModuleCallable(HttpModuleImpl), ""}
+	Name: "http", Kind: "builtin",
+	Parameters: []ModuleParameter{
+		{Name: "url", Type: TypeString, Required: true, Pattern: "^https?://", Description: "URL to request"},
+		{Name: "method", Type: TypeString, Default: "GET", Description: "HTTP method",
+			Enum: []interface{}{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}},
+		{Name: "headers", Type: TypeMap, Default: map[string]interface{}{}, Description: "Request headers"},
+		{Name: "body", Type: TypeString, Description: "Request body"},
+		{Name: "timeout", Type: TypeNumber, Default: 10.0, Min: Float(0), Description: "Timeout in seconds"},
+		{Name: "include_response", Type: TypeBool, Default: false, Description: "Add the response body to the event"}},
+	Callable: ModuleCallable(HttpModuleImpl)}
 
 func HttpModuleImpl(input ModuleParamList) EventList {
 	var reader *strings.Reader
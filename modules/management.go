@@ -1,7 +1,6 @@
 package modules
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -12,23 +11,20 @@ import (
 
 	"github.com/amir/raidman"
 	"github.com/op/go-logging"
+
+	"github.com/avalente/riemann-agent/cfgfile"
 )
 
 var log = logging.MustGetLogger("riemann-agent-modules")
 
-type ModuleParameter struct {
-	Name     string
-	Type     string
-	Required bool
-	Default  interface{}
-}
-
 type Module struct {
 	Name       string
 	Kind       string
 	Parameters []ModuleParameter
 	Callable   ModuleCallable
 	Executable string
+	// directory of the custom modules, empty for the builtin ones
+	Path string `json:"-"`
 }
 
 type ModuleParamList map[string]interface{}
@@ -42,31 +38,38 @@ func NewEventList(events ...*raidman.Event) EventList {
 
 func GetBuiltinModules() []Module {
 	pingModule := Module{
-		"ping", "builtin",
-		[]ModuleParameter{ModuleParameter{"target", "string", true, nil}},
-		ModuleCallable(PingModuleImpl), ""}
+		Name: "ping", Kind: "builtin",
+		Parameters: []ModuleParameter{
+			{Name: "target", Type: TypeString, Required: true, Description: "Host to ping"}},
+		Callable: ModuleCallable(PingModuleImpl)}
 
 	fakeModule := Module{
-		"fake", "builtin",
-		[]ModuleParameter{
-			ModuleParameter{"attribute", "string", true, nil},
-			ModuleParameter{"value1", "number", true, nil},
-			ModuleParameter{"value2", "number", false, 42}},
-		ModuleCallable(FakeModuleImpl), ""}
+		Name: "fake", Kind: "builtin",
+		Parameters: []ModuleParameter{
+			{Name: "attribute", Type: TypeString, Required: true, Description: "Value of the test attribute"},
+			{Name: "value1", Type: TypeNumber, Required: true, Description: "Metric of the first event"},
+			{Name: "value2", Type: TypeNumber, Default: 42, Description: "Metric of the second event"}},
+		Callable: ModuleCallable(FakeModuleImpl)}
 
 	return []Module{pingModule, fakeModule, HttpModule}
 }
 
-func GetCustomModules(directory string) []Module {
+// ReadCustomModules loads the custom modules, returning also the errors of
+// the invalid ones
+func ReadCustomModules(directory string) ([]Module, []error) {
 	log.Debug("Getting custom modules from %v", directory)
 
 	files, err := ioutil.ReadDir(directory)
 	if err != nil {
 		log.Error("Can't read custom modules: %v\n", err)
-		return []Module{}
+		if os.IsNotExist(err) {
+			return []Module{}, nil
+		}
+		return []Module{}, []error{err}
 	}
 
 	modules := []Module{}
+	errs := []error{}
 
 	for _, entry := range files {
 		if entry.IsDir() {
@@ -80,25 +83,40 @@ func GetCustomModules(directory string) []Module {
 			mod, err := ReadCustomModule(dir)
 			if err != nil {
 				log.Error("Can't read module %v: %v", name, err)
+				errs = append(errs, fmt.Errorf("can't read module %v: %v", name, err))
 			} else {
 				modules = append(modules, *mod)
 			}
 		}
 	}
 
-	return modules
+	return modules, errs
+}
+
+// metadataFile returns the metadata file of the module in the given
+// directory, in any of the supported formats
+func metadataFile(directory string) (string, error) {
+	for _, ext := range cfgfile.Extensions() {
+		fileName := filepath.Join(directory, "metadata"+ext)
+		if _, err := os.Stat(fileName); err == nil {
+			return fileName, nil
+		}
+	}
+	return "", fmt.Errorf("no metadata file found in %s", directory)
 }
 
 func ReadCustomModule(directory string) (*Module, error) {
-	file, err := os.Open(filepath.Join(directory, "metadata.json"))
+	fileName, err := metadataFile(directory)
 	if err != nil {
 		return nil, err
 	} else {
-		defer file.Close()
+		doc, err := cfgfile.Read(fileName)
+		if err != nil {
+			return nil, err
+		}
 
-		decoder := json.NewDecoder(file)
 		mod := Module{}
-		err = decoder.Decode(&mod)
+		err = doc.Decode(&mod)
 		if err != nil {
 			return nil, err
 		}
@@ -115,70 +133,82 @@ func ReadCustomModule(directory string) (*Module, error) {
 		}
 
 		if e != "" {
-			return nil, errors.New(e)
+			return nil, &cfgfile.FileError{File: fileName, Err: errors.New(e)}
 		}
 
-		merr := checkCustomModuleParameters(&mod.Parameters)
+		merr := checkParameters(mod.Parameters)
 		if merr != "" {
-			return nil, errors.New(merr)
+			return nil, doc.Errorf([]string{"Parameters"}, "%s", merr)
 		}
 
+		mod.Path = directory
+
 		if mod.Executable == "" {
 			mod.Executable = filepath.Join(directory, mod.Name)
 		}
 
+		info, err := os.Stat(mod.Executable)
+		switch {
+		case err != nil:
+			return nil, doc.Errorf([]string{"Executable"}, "%v", err)
+		case info.IsDir() || info.Mode()&0111 == 0:
+			return nil, doc.Errorf([]string{"Executable"}, "%s is not executable", mod.Executable)
+		}
+
 		log.Debug("Loaded custom module %v (%s)", mod.Name, mod.Kind)
 		return &mod, nil
 	}
 }
 
-func checkCustomModuleParameters(params *[]ModuleParameter) string {
-	if len(*params) == 0 {
-		return ""
-	}
-
-	names := map[string]bool{}
-
-	for _, p := range *params {
-		_, found := names[p.Name]
-		if found {
-			return fmt.Sprintf("duplicated parameter name <%s>", p.Name)
-		}
-		names[p.Name] = true
-
-		if p.Type == "" {
-			return fmt.Sprintf("no parameter type for <%s>", p.Name)
-		}
+func ScanModules(modulesDir string) map[string]Module {
+	res, _, _ := ReadModules(modulesDir)
+	return res
+}
 
-		if p.Type != "bool" && p.Type != "number" && p.Type != "string" && p.Type != "map" {
-			return fmt.Sprintf("bad parameter type for <%s>: %s", p.Name, p.Type)
-		}
+// Shadowing is a custom module hiding another module with the same name
+type Shadowing struct {
+	Module   Module
+	Shadowed Module
+}
 
-		//TODO: check that the default value is of the correct type
+// Location returns the directory of the custom module, or "builtin"
+func (mod Module) Location() string {
+	if mod.Path == "" {
+		return "builtin"
 	}
-
-	return ""
+	return mod.Path
 }
 
-func ScanModules(modulesDir string) map[string]Module {
+// ReadModules returns the builtin and custom modules by name, together with
+// the modules shadowed by custom ones and the errors of the invalid ones
+func ReadModules(modulesDir string) (map[string]Module, []Shadowing, []error) {
 	builtin := GetBuiltinModules()
-	custom := GetCustomModules(modulesDir)
+	custom, errs := ReadCustomModules(modulesDir)
 
 	res := make(map[string]Module)
 
 	for _, mod := range builtin {
+		merr := checkParameters(mod.Parameters)
+		if merr != "" {
+			log.Error("Bad builtin module %v: %s", mod.Name, merr)
+			errs = append(errs, fmt.Errorf("bad builtin module %v: %s", mod.Name, merr))
+			continue
+		}
 		res[mod.Name] = mod
 	}
 
+	shadowings := []Shadowing{}
+
 	for _, mod := range custom {
-		_, found := res[mod.Name]
+		previous, found := res[mod.Name]
 		if found {
-			log.Warning("Custom module <%s> will shadow builtin one", mod.Name)
+			log.Warning("Custom module <%s> will shadow the one in %s", mod.Name, previous.Location())
+			shadowings = append(shadowings, Shadowing{mod, previous})
 		}
 		res[mod.Name] = mod
 	}
 
-	return res
+	return res, shadowings, errs
 }
 
 func PingModuleImpl(input ModuleParamList) EventList {
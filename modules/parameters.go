@@ -0,0 +1,317 @@
+package modules
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Parameter types
+const (
+	TypeBool   = "bool"
+	TypeString = "string"
+	// any number; integer and float restrict it
+	TypeNumber  = "number"
+	TypeInteger = "integer"
+	TypeFloat   = "float"
+	// a string parsed by time.ParseDuration ("30s", "5m")
+	TypeDuration = "duration"
+	// a map, whose keys are described by Fields (free-form if empty)
+	TypeMap = "map"
+	// a list, whose items are described by Items (any value if nil)
+	TypeList = "list"
+)
+
+var parameterTypes = []string{TypeBool, TypeString, TypeNumber, TypeInteger, TypeFloat, TypeDuration, TypeMap, TypeList}
+
+type ModuleParameter struct {
+	Name        string
+	Type        string
+	Required    bool
+	Default     interface{}
+	Description string
+	// allowed values, for strings, numbers and durations
+	Enum []interface{}
+	// bounds of numbers and durations (in seconds)
+	Min *float64
+	Max *float64
+	// regular expression matching the strings
+	Pattern string
+	// schema of the list items
+	Items *ModuleParameter
+	// schema of the map keys
+	Fields []ModuleParameter
+}
+
+// Float returns a pointer to the given value, for the parameter bounds
+func Float(value float64) *float64 {
+	return &value
+}
+
+func isNumeric(paramType string) bool {
+	return paramType == TypeNumber || paramType == TypeInteger || paramType == TypeFloat
+}
+
+// valueType returns the parameter type matching the Go value, without
+// distinguishing between the kinds of numbers
+func valueType(value interface{}) string {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Bool:
+		return TypeBool
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return TypeNumber
+	case reflect.String:
+		return TypeString
+	case reflect.Map:
+		if v.Type().Key().Kind() == reflect.String {
+			return TypeMap
+		}
+	case reflect.Slice, reflect.Array:
+		return TypeList
+	}
+	return ""
+}
+
+func toFloat(value interface{}) float64 {
+	return reflect.ValueOf(value).Convert(reflect.TypeOf(float64(0))).Float()
+}
+
+// Validate checks the value against the parameter type and constraints;
+// nil values are accepted, the required parameters are checked by the
+// caller
+func (p *ModuleParameter) Validate(value interface{}) error {
+	if value == nil {
+		return nil
+	}
+
+	vtype := valueType(value)
+	if vtype == "" {
+		return fmt.Errorf("unsupported type %T", value)
+	}
+
+	expected := p.Type
+	switch {
+	case isNumeric(p.Type):
+		expected = TypeNumber
+	case p.Type == TypeDuration:
+		expected = TypeString
+	}
+
+	if vtype != expected {
+		return fmt.Errorf("%s not %s", vtype, p.Type)
+	}
+
+	var number float64
+
+	switch p.Type {
+	case TypeNumber, TypeFloat:
+		number = toFloat(value)
+	case TypeInteger:
+		number = toFloat(value)
+		if number != math.Trunc(number) {
+			return fmt.Errorf("%v not integer", value)
+		}
+	case TypeDuration:
+		d, err := time.ParseDuration(value.(string))
+		if err != nil {
+			return fmt.Errorf("bad duration %q", value)
+		}
+		number = d.Seconds()
+	case TypeString:
+		if p.Pattern != "" {
+			re, err := regexp.Compile(p.Pattern)
+			if err != nil {
+				return fmt.Errorf("bad pattern %s: %v", p.Pattern, err)
+			}
+			if !re.MatchString(value.(string)) {
+				return fmt.Errorf("%q doesn't match %s", value, p.Pattern)
+			}
+		}
+	case TypeList:
+		if p.Items != nil {
+			v := reflect.ValueOf(value)
+			for i := 0; i < v.Len(); i++ {
+				err := p.Items.Validate(v.Index(i).Interface())
+				if err != nil {
+					return fmt.Errorf("item %d: %v", i, err)
+				}
+			}
+		}
+	case TypeMap:
+		if len(p.Fields) > 0 {
+			return p.validateFields(value)
+		}
+	}
+
+	if isNumeric(p.Type) || p.Type == TypeDuration {
+		if p.Min != nil && number < *p.Min {
+			return fmt.Errorf("%v below the minimum %v", value, *p.Min)
+		}
+		if p.Max != nil && number > *p.Max {
+			return fmt.Errorf("%v above the maximum %v", value, *p.Max)
+		}
+	}
+
+	if len(p.Enum) > 0 && !p.inEnum(value) {
+		return fmt.Errorf("%v not in %v", value, p.Enum)
+	}
+
+	return nil
+}
+
+func (p *ModuleParameter) inEnum(value interface{}) bool {
+	for _, allowed := range p.Enum {
+		if isNumeric(p.Type) && valueType(allowed) == TypeNumber {
+			if toFloat(allowed) == toFloat(value) {
+				return true
+			}
+		} else if allowed == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *ModuleParameter) validateFields(value interface{}) error {
+	v := reflect.ValueOf(value)
+
+	known := map[string]bool{}
+	for i := range p.Fields {
+		field := &p.Fields[i]
+		known[field.Name] = true
+
+		fieldValue := v.MapIndex(reflect.ValueOf(field.Name))
+		if !fieldValue.IsValid() || fieldValue.Interface() == nil {
+			if field.Required {
+				return fmt.Errorf("missing %s", field.Name)
+			}
+			continue
+		}
+
+		err := field.Validate(fieldValue.Interface())
+		if err != nil {
+			return fmt.Errorf("%s: %v", field.Name, err)
+		}
+	}
+
+	unknown := []string{}
+	for _, key := range v.MapKeys() {
+		if !known[key.String()] {
+			unknown = append(unknown, key.String())
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown keys %s", strings.Join(unknown, ", "))
+	}
+
+	return nil
+}
+
+// checkParameters checks the declaration of the parameters, including
+// their default values
+func checkParameters(params []ModuleParameter) string {
+	names := map[string]bool{}
+
+	for i := range params {
+		p := &params[i]
+
+		if p.Name == "" {
+			return "parameter without name"
+		}
+
+		_, found := names[p.Name]
+		if found {
+			return fmt.Sprintf("duplicated parameter name <%s>", p.Name)
+		}
+		names[p.Name] = true
+
+		err := checkParameter(p)
+		if err != "" {
+			return err
+		}
+	}
+
+	return ""
+}
+
+func checkParameter(p *ModuleParameter) string {
+	if p.Type == "" {
+		return fmt.Sprintf("no parameter type for <%s>", p.Name)
+	}
+
+	known := false
+	for _, t := range parameterTypes {
+		known = known || t == p.Type
+	}
+	if !known {
+		return fmt.Sprintf("bad parameter type for <%s>: %s", p.Name, p.Type)
+	}
+
+	numeric := isNumeric(p.Type) || p.Type == TypeDuration
+
+	switch {
+	case (p.Min != nil || p.Max != nil) && !numeric:
+		return fmt.Sprintf("min and max not allowed for <%s> (%s)", p.Name, p.Type)
+	case p.Min != nil && p.Max != nil && *p.Min > *p.Max:
+		return fmt.Sprintf("min above max for <%s>", p.Name)
+	case p.Pattern != "" && p.Type != TypeString:
+		return fmt.Sprintf("pattern not allowed for <%s> (%s)", p.Name, p.Type)
+	case len(p.Enum) > 0 && !numeric && p.Type != TypeString:
+		return fmt.Sprintf("enum not allowed for <%s> (%s)", p.Name, p.Type)
+	case p.Items != nil && p.Type != TypeList:
+		return fmt.Sprintf("items not allowed for <%s> (%s)", p.Name, p.Type)
+	case len(p.Fields) > 0 && p.Type != TypeMap:
+		return fmt.Sprintf("fields not allowed for <%s> (%s)", p.Name, p.Type)
+	}
+
+	if p.Pattern != "" {
+		_, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			return fmt.Sprintf("bad pattern for <%s>: %v", p.Name, err)
+		}
+	}
+
+	if p.Items != nil {
+		if p.Items.Name == "" {
+			p.Items.Name = p.Name + "[]"
+		}
+		err := checkParameter(p.Items)
+		if err != "" {
+			return err
+		}
+	}
+
+	if len(p.Fields) > 0 {
+		err := checkParameters(p.Fields)
+		if err != "" {
+			return fmt.Sprintf("<%s>: %s", p.Name, err)
+		}
+	}
+
+	// the enum values must be valid themselves
+	enum := p.Enum
+	p.Enum = nil
+	for _, value := range enum {
+		err := p.Validate(value)
+		if err != nil {
+			p.Enum = enum
+			return fmt.Sprintf("bad enum value for <%s>: %v", p.Name, err)
+		}
+	}
+	p.Enum = enum
+
+	err := p.Validate(p.Default)
+	if err != nil {
+		return fmt.Sprintf("bad default for <%s>: %v", p.Name, err)
+	}
+
+	return ""
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/amir/raidman"
+)
+
+// OnChange configures a driver to forward an event only when its state
+// changes (or its metric changes by at least Delta, if set); an unchanged
+// event is sent anyway every Heartbeat seconds (by default half the ttl of
+// the driver)
+type OnChange struct {
+	Enabled   bool
+	Delta     float64
+	Heartbeat int
+}
+
+func (o *OnChange) Validate(ttl float32) error {
+	if !o.Enabled {
+		return nil
+	}
+
+	if o.Delta < 0 {
+		return fmt.Errorf("bad delta: %v", o.Delta)
+	}
+
+	if o.Heartbeat < 0 {
+		return fmt.Errorf("bad heartbeat: %v", o.Heartbeat)
+	}
+
+	if ttl <= 0 && o.Heartbeat == 0 {
+		return fmt.Errorf("heartbeat required without a ttl")
+	}
+
+	if ttl > 0 && float32(o.Heartbeat) >= ttl {
+		return fmt.Errorf("heartbeat (%v) must be less than the ttl (%v)", o.Heartbeat, ttl)
+	}
+
+	return nil
+}
+
+func (o *OnChange) heartbeat(ttl float32) time.Duration {
+	if o.Heartbeat > 0 {
+		return time.Duration(o.Heartbeat) * time.Second
+	}
+	return time.Duration(float64(ttl) / 2 * float64(time.Second))
+}
+
+type sentEvent struct {
+	state  string
+	metric float64
+	time   time.Time
+}
+
+// changeTracker keeps the last event sent, by host and service
+type changeTracker struct {
+	sync.Mutex
+	sent map[[2]string]sentEvent
+}
+
+func newChangeTracker() *changeTracker {
+	return &changeTracker{sent: map[[2]string]sentEvent{}}
+}
+
+// ShouldSend returns true if the event must be forwarded, i.e. it's the
+// first one, it changed or the heartbeat expired; ttl is the one of the
+// driver, as in Validate
+func (o *OnChange) ShouldSend(tracker *changeTracker, ev *raidman.Event, ttl float32, now time.Time) bool {
+	if !o.Enabled {
+		return true
+	}
+
+	metric, _ := metricValue(ev)
+
+	tracker.Lock()
+	defer tracker.Unlock()
+
+	key := [2]string{ev.Host, ev.Service}
+	last, found := tracker.sent[key]
+
+	changed := !found ||
+		last.state != ev.State ||
+		(o.Delta > 0 && math.Abs(metric-last.metric) >= o.Delta)
+
+	heartbeat := o.heartbeat(ttl)
+	if !changed && (heartbeat <= 0 || now.Sub(last.time) < heartbeat) {
+		return false
+	}
+
+	tracker.sent[key] = sentEvent{ev.State, metric, now}
+	return true
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/amir/raidman"
+)
+
+func TestOnChangeState(m *testing.T) {
+	o := OnChange{Enabled: true, Heartbeat: 60}
+	tracker := newChangeTracker()
+	now := time.Now()
+
+	send := func(state string, seconds int) bool {
+		ev := raidman.Event{Service: "s", State: state}
+		return o.ShouldSend(tracker, &ev, 120, now.Add(time.Duration(seconds)*time.Second))
+	}
+
+	AssertEqual(m, send("ok", 0), true)
+	AssertEqual(m, send("ok", 10), false)
+	AssertEqual(m, send("critical", 20), true)
+	AssertEqual(m, send("critical", 30), false)
+	// heartbeat
+	AssertEqual(m, send("critical", 80), true)
+	AssertEqual(m, send("critical", 90), false)
+}
+
+func TestOnChangeDelta(m *testing.T) {
+	o := OnChange{Enabled: true, Delta: 5}
+	tracker := newChangeTracker()
+	now := time.Now()
+
+	send := func(metric float64, seconds int) bool {
+		ev := raidman.Event{Service: "s", State: "ok", Metric: metric}
+		return o.ShouldSend(tracker, &ev, 60, now.Add(time.Duration(seconds)*time.Second))
+	}
+
+	AssertEqual(m, send(10, 0), true)
+	AssertEqual(m, send(12, 1), false)
+	AssertEqual(m, send(15, 2), true)
+	AssertEqual(m, send(11, 3), false)
+	// default heartbeat: half the ttl
+	AssertEqual(m, send(11, 32), true)
+}
+
+func TestOnChangeDisabled(m *testing.T) {
+	o := OnChange{}
+	tracker := newChangeTracker()
+	ev := raidman.Event{Service: "s"}
+
+	AssertEqual(m, o.ShouldSend(tracker, &ev, 60, time.Now()), true)
+	AssertEqual(m, o.ShouldSend(tracker, &ev, 60, time.Now()), true)
+}
+
+func TestOnChangeValidation(m *testing.T) {
+	bad := []OnChange{
+		{Enabled: true, Delta: -1},
+		{Enabled: true, Heartbeat: -1},
+		{Enabled: true, Heartbeat: 60},
+	}
+
+	for _, o := range bad {
+		if o.Validate(60) == nil {
+			m.Errorf("error expected for %+v", o)
+		}
+	}
+
+	// without a ttl, the heartbeat is required
+	o := OnChange{Enabled: true}
+	if o.Validate(0) == nil {
+		m.Errorf("error expected without heartbeat and ttl")
+	}
+	o.Heartbeat = 30
+	if err := o.Validate(0); err != nil {
+		m.Errorf("no error expected, found %v", err)
+	}
+}
+
+func TestOnChangeFromDriverFile(m *testing.T) {
+	dir := createDriversDir(m, map[string]string{
+		"a.yaml": "description: a\nmodule: ping\nttl: 60\nonChange: {enabled: true, delta: 5}\n",
+		"b.yaml": "description: b\nmodule: ping\nttl: 0\nOnChange: {enabled: true}\n",
+	})
+
+	drivers, errs := ReadDrivers(testModules(), testConfiguration(dir))
+	AssertEqual(m, len(drivers), 1)
+	AssertEqual(m, drivers[0].OnChange.Enabled, true)
+	AssertEqual(m, drivers[0].OnChange.Delta, 5.0)
+	AssertEqual(m, len(errs), 1)
+}
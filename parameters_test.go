@@ -0,0 +1,109 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/avalente/riemann-agent/modules"
+)
+
+func checkValid(m *testing.T, param modules.ModuleParameter, values ...interface{}) {
+	for _, value := range values {
+		if err := ValidateType(param, value); err != nil {
+			m.Errorf("%v expected valid for %s: %s", value, param.Type, *err)
+		}
+	}
+}
+
+func checkInvalid(m *testing.T, param modules.ModuleParameter, values ...interface{}) {
+	for _, value := range values {
+		if ValidateType(param, value) == nil {
+			m.Errorf("%v expected invalid for %s", value, param.Type)
+		}
+	}
+}
+
+func TestValidateTypeScalars(m *testing.T) {
+	checkValid(m, modules.ModuleParameter{Name: "p", Type: "number"}, 1, 1.5, nil)
+	checkInvalid(m, modules.ModuleParameter{Name: "p", Type: "number"}, "1", true)
+
+	checkValid(m, modules.ModuleParameter{Name: "p", Type: "integer"}, 3, 3.0)
+	checkInvalid(m, modules.ModuleParameter{Name: "p", Type: "integer"}, 3.5)
+
+	checkValid(m, modules.ModuleParameter{Name: "p", Type: "duration", Max: modules.Float(60)}, "30s", "1m")
+	checkInvalid(m, modules.ModuleParameter{Name: "p", Type: "duration", Max: modules.Float(60)}, "2m", "soon", 30)
+
+	checkValid(m, modules.ModuleParameter{Name: "p", Type: "float", Min: modules.Float(0), Max: modules.Float(1)}, 0, 0.5, 1)
+	checkInvalid(m, modules.ModuleParameter{Name: "p", Type: "float", Min: modules.Float(0), Max: modules.Float(1)}, -1, 1.1)
+
+	checkValid(m, modules.ModuleParameter{Name: "p", Type: "string", Enum: []interface{}{"GET", "POST"}}, "GET")
+	checkInvalid(m, modules.ModuleParameter{Name: "p", Type: "string", Enum: []interface{}{"GET", "POST"}}, "get")
+
+	checkValid(m, modules.ModuleParameter{Name: "p", Type: "integer", Enum: []interface{}{1, 2}}, 2.0)
+
+	checkValid(m, modules.ModuleParameter{Name: "p", Type: "string", Pattern: "^[a-z]+$"}, "abc")
+	checkInvalid(m, modules.ModuleParameter{Name: "p", Type: "string", Pattern: "^[a-z]+$"}, "ABC")
+
+	err := ValidateType(modules.ModuleParameter{Name: "p", Type: "number"}, "x")
+	AssertEqual(m, *err, "p (string not number)")
+}
+
+func TestValidateTypeCompound(m *testing.T) {
+	list := modules.ModuleParameter{Name: "p", Type: "list", Items: &modules.ModuleParameter{Type: "string"}}
+	checkValid(m, list, []interface{}{"a", "b"}, []string{}, []interface{}{})
+	checkInvalid(m, list, []interface{}{"a", 1}, "a")
+
+	endpoint := modules.ModuleParameter{Name: "p", Type: "map", Fields: []modules.ModuleParameter{
+		{Name: "url", Type: "string", Required: true},
+		{Name: "port", Type: "integer"},
+	}}
+	checkValid(m, endpoint, map[string]interface{}{"url": "x"}, map[string]interface{}{"url": "x", "port": 80})
+	checkInvalid(m, endpoint, map[string]interface{}{"port": 80}, map[string]interface{}{"url": "x", "other": 1})
+
+	endpoints := modules.ModuleParameter{Name: "p", Type: "list", Items: &endpoint}
+	checkValid(m, endpoints, []interface{}{map[string]interface{}{"url": "x"}})
+	checkInvalid(m, endpoints, []interface{}{map[string]interface{}{"url": 1}})
+
+	checkValid(m, modules.ModuleParameter{Name: "p", Type: "map"}, map[string]interface{}{"a": 1}, map[string]string{})
+}
+
+func TestGetParametersConstraints(m *testing.T) {
+	drv := Driver{ModuleObject: modules.HttpModule, Configuration: map[string]interface{}{
+		"url": "ftp://example.com", "method": "FETCH", "timeout": -1.0,
+	}}
+
+	_, err := GetParameters(drv)
+	AssertEqual(m, strings.Count(err, "("), 3)
+
+	drv.Configuration = map[string]interface{}{"url": "http://example.com"}
+	params, err := GetParameters(drv)
+	AssertEqual(m, err, "")
+	AssertEqual(m, params["timeout"], 10.0)
+}
+
+func TestModuleParametersCheckedAtLoad(m *testing.T) {
+	dir := createModulesDir(m, map[string]string{
+		"good": "name: good\nkind: executable\nparameters:\n" +
+			"- {name: interval, type: duration, default: 30s, min: 1}\n" +
+			"- {name: targets, type: list, items: {type: string}, default: [a, b]}\n",
+		"baddefault": "name: baddefault\nkind: executable\nparameters:\n" +
+			"- {name: count, type: integer, default: 1.5}\n",
+		"badenum": "name: badenum\nkind: executable\nparameters:\n" +
+			"- {name: mode, type: string, enum: [a, 1]}\n",
+		"badconstraint": "name: badconstraint\nkind: executable\nparameters:\n" +
+			"- {name: flag, type: bool, min: 1}\n",
+		"badtype": "name: badtype\nkind: executable\nparameters:\n" +
+			"- {name: value, type: complex}\n",
+	})
+
+	available, _, errs := modules.ReadModules(dir)
+
+	AssertEqual(m, len(errs), 4)
+	AssertEqual(m, available["good"].Name, "good")
+	AssertEqual(m, available["baddefault"].Name, "")
+
+	// the builtin modules are valid
+	_, _, errs = modules.ReadModules(filepath.Join(ctx.dir, "no-modules"))
+	AssertEqual(m, len(errs), 0)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"time"
+
+	"github.com/avalente/riemann-agent/modules"
+)
+
+// processEvents turns the events produced by the module into the events
+// to be sent to riemann: driver fields and templates are applied first,
+// then the processors transform (or drop) the events, counters are
+// converted to rates and thresholds set the states, on the transformed
+// metrics. The local alerts are
+// checked at this point, before any event is suppressed. Aggregated
+// services are then replaced by their summaries at the end of each window
+// and finally flapping services are detected and unchanged events are
+// suppressed, if requested.
+func (drv *Driver) processEvents(events modules.EventList, params modules.ModuleParamList) modules.EventList {
+	now := time.Now()
+
+	pending := modules.EventList{}
+	if drv.aggregationWindow != nil {
+		for _, ev := range drv.Aggregation.Flush(drv.aggregationWindow, now, drv.interval()) {
+			drv.alerter.Check(ev)
+			pending = append(pending, ev)
+		}
+	}
+
+	for _, ev := range events {
+		drv.completeEvent(ev, params)
+
+		if !applyProcessors(drv.processors, ev) {
+			continue
+		}
+
+		if drv.counterTracker != nil && !drv.Counters.Rate(drv.counterTracker, ev, now) {
+			continue
+		}
+
+		drv.Thresholds.Apply(ev)
+
+		drv.alerter.Check(ev)
+
+		if drv.aggregationWindow != nil && !drv.Aggregation.Add(drv.aggregationWindow, ev, now) {
+			continue
+		}
+
+		pending = append(pending, ev)
+	}
+
+	res := make(modules.EventList, 0, len(pending))
+
+	for _, ev := range pending {
+		if drv.flapTracker != nil {
+			ev = drv.Flapping.Check(drv.flapTracker, ev, now)
+			if ev == nil {
+				continue
+			}
+		}
+
+		if drv.changeTracker != nil && !drv.OnChange.ShouldSend(drv.changeTracker, ev, drv.Ttl, now) {
+			continue
+		}
+
+		res = append(res, ev)
+	}
+
+	return res
+}
+
+// emit enqueues the events for riemann; when the queue is full (riemann
+// unreachable for a long time) the events are dropped rather than blocking
+// the workers, the alerts being already checked
+func (drv *Driver) emit(events modules.EventList, queue ResQueue) {
+	dropped := 0
+
+	for _, ev := range events {
+		select {
+		case queue <- ev:
+		default:
+			dropped++
+		}
+	}
+
+	if dropped > 0 {
+		log.Warning("Queue full, %d events of driver %s dropped", dropped, drv.Id)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/amir/raidman"
+)
+
+// ProcessorConfig is the declaration of an event processor in a driver
+// file. Service and State are regular expressions restricting the events
+// the processor applies to (all of them if empty).
+type ProcessorConfig struct {
+	Type      string
+	Service   string
+	State     string
+	To        string
+	Factor    float64
+	Name      string
+	Value     string
+	Tag       string
+	Precision int
+	Attribute string
+}
+
+// Processor transforms an event; it returns false if the event must be
+// dropped
+type Processor func(ev *raidman.Event) bool
+
+// eventMatcher selects events by service and state
+type eventMatcher struct {
+	service *regexp.Regexp
+	state   *regexp.Regexp
+}
+
+func newEventMatcher(service string, state string) (*eventMatcher, error) {
+	res := &eventMatcher{}
+	var err error
+
+	if service != "" {
+		res.service, err = regexp.Compile(service)
+		if err != nil {
+			return nil, fmt.Errorf("bad service expression: %v", err)
+		}
+	}
+
+	if state != "" {
+		res.state, err = regexp.Compile(state)
+		if err != nil {
+			return nil, fmt.Errorf("bad state expression: %v", err)
+		}
+	}
+
+	return res, nil
+}
+
+func (m *eventMatcher) Match(ev *raidman.Event) bool {
+	return (m.service == nil || m.service.MatchString(ev.Service)) &&
+		(m.state == nil || m.state.MatchString(ev.State))
+}
+
+// NewProcessor builds the processor described by the given configuration
+func NewProcessor(cfg ProcessorConfig) (Processor, error) {
+	match, err := newEventMatcher(cfg.Service, cfg.State)
+	if err != nil {
+		return nil, err
+	}
+
+	// apply fun to the matching events, keeping the others
+	onMatch := func(fun func(ev *raidman.Event)) Processor {
+		return func(ev *raidman.Event) bool {
+			if match.Match(ev) {
+				fun(ev)
+			}
+			return true
+		}
+	}
+
+	switch cfg.Type {
+	case "drop":
+		return func(ev *raidman.Event) bool {
+			return !match.Match(ev)
+		}, nil
+
+	case "keep":
+		return func(ev *raidman.Event) bool {
+			return match.Match(ev)
+		}, nil
+
+	case "rename":
+		if cfg.Service == "" || cfg.To == "" {
+			return nil, fmt.Errorf("rename: service and to are required")
+		}
+		return onMatch(func(ev *raidman.Event) {
+			ev.Service = match.service.ReplaceAllString(ev.Service, cfg.To)
+		}), nil
+
+	case "scale":
+		if cfg.Factor == 0 {
+			return nil, fmt.Errorf("scale: factor is required")
+		}
+		return onMatch(func(ev *raidman.Event) {
+			if value, ok := metricValue(ev); ok {
+				ev.Metric = value * cfg.Factor
+			}
+		}), nil
+
+	case "round":
+		if cfg.Precision < 0 {
+			return nil, fmt.Errorf("round: bad precision %d", cfg.Precision)
+		}
+		exp := math.Pow(10, float64(cfg.Precision))
+		return onMatch(func(ev *raidman.Event) {
+			if value, ok := metricValue(ev); ok {
+				ev.Metric = math.Round(value*exp) / exp
+			}
+		}), nil
+
+	case "set_attribute":
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("set_attribute: name is required")
+		}
+		return onMatch(func(ev *raidman.Event) {
+			if ev.Attributes == nil {
+				ev.Attributes = map[string]string{}
+			}
+			ev.Attributes[cfg.Name] = cfg.Value
+		}), nil
+
+	case "remove_attribute":
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("remove_attribute: name is required")
+		}
+		return onMatch(func(ev *raidman.Event) {
+			delete(ev.Attributes, cfg.Name)
+		}), nil
+
+	case "add_tag":
+		if cfg.Tag == "" {
+			return nil, fmt.Errorf("add_tag: tag is required")
+		}
+		return onMatch(func(ev *raidman.Event) {
+			ev.Tags = mergeTags(ev.Tags, []string{cfg.Tag})
+		}), nil
+
+	case "remove_tag":
+		if cfg.Tag == "" {
+			return nil, fmt.Errorf("remove_tag: tag is required")
+		}
+		return onMatch(func(ev *raidman.Event) {
+			tags := make([]string, 0, len(ev.Tags))
+			for _, tag := range ev.Tags {
+				if tag != cfg.Tag {
+					tags = append(tags, tag)
+				}
+			}
+			ev.Tags = tags
+		}), nil
+
+	case "parse_metric":
+		// the metric (or the given attribute) as a number
+		return onMatch(func(ev *raidman.Event) {
+			var text string
+			if cfg.Attribute != "" {
+				text = ev.Attributes[cfg.Attribute]
+			} else if s, ok := ev.Metric.(string); ok {
+				text = s
+			} else {
+				return
+			}
+
+			value, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+			if err == nil {
+				ev.Metric = value
+			} else if cfg.Attribute == "" {
+				// a string metric can't be sent anyway
+				ev.Metric = nil
+			}
+		}), nil
+
+	case "":
+		return nil, fmt.Errorf("missing processor type")
+	}
+
+	return nil, fmt.Errorf("unknown processor type: %s", cfg.Type)
+}
+
+// NewProcessors builds the processors in the given order
+func NewProcessors(configs []ProcessorConfig) ([]Processor, error) {
+	res := make([]Processor, 0, len(configs))
+
+	for i, cfg := range configs {
+		proc, err := NewProcessor(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("processor %d: %v", i+1, err)
+		}
+		res = append(res, proc)
+	}
+
+	return res, nil
+}
+
+// applyProcessors runs the event through the processors; it returns false
+// as soon as one of them drops it
+func applyProcessors(processors []Processor, ev *raidman.Event) bool {
+	for _, proc := range processors {
+		if !proc(ev) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/amir/raidman"
+)
+
+func newTestProcessor(m *testing.T, cfg ProcessorConfig) Processor {
+	proc, err := NewProcessor(cfg)
+	if err != nil {
+		m.Fatalf("No errors expected, found %v", err)
+	}
+	return proc
+}
+
+func TestProcessorDrop(m *testing.T) {
+	proc := newTestProcessor(m, ProcessorConfig{Type: "drop", Service: "^debug", State: "^ok$"})
+
+	AssertEqual(m, proc(&raidman.Event{Service: "debug x", State: "ok"}), false)
+	AssertEqual(m, proc(&raidman.Event{Service: "debug x", State: "critical"}), true)
+	AssertEqual(m, proc(&raidman.Event{Service: "x", State: "ok"}), true)
+}
+
+func TestProcessorKeep(m *testing.T) {
+	proc := newTestProcessor(m, ProcessorConfig{Type: "keep", State: "warning|critical"})
+
+	AssertEqual(m, proc(&raidman.Event{State: "ok"}), false)
+	AssertEqual(m, proc(&raidman.Event{State: "critical"}), true)
+}
+
+func TestProcessorRename(m *testing.T) {
+	proc := newTestProcessor(m, ProcessorConfig{Type: "rename", Service: "^disk free (.*)$", To: "df $1"})
+
+	ev := raidman.Event{Service: "disk free /home"}
+	AssertEqual(m, proc(&ev), true)
+	AssertEqual(m, ev.Service, "df /home")
+
+	ev = raidman.Event{Service: "load"}
+	proc(&ev)
+	AssertEqual(m, ev.Service, "load")
+}
+
+func TestProcessorScale(m *testing.T) {
+	proc := newTestProcessor(m, ProcessorConfig{Type: "scale", Factor: 0.001})
+
+	ev := raidman.Event{Metric: 2500}
+	proc(&ev)
+	AssertEqual(m, ev.Metric, 2.5)
+
+	ev = raidman.Event{}
+	proc(&ev)
+	AssertEqual(m, ev.Metric, nil)
+}
+
+func TestProcessorRound(m *testing.T) {
+	proc := newTestProcessor(m, ProcessorConfig{Type: "round", Precision: 2})
+
+	ev := raidman.Event{Metric: 1.23456}
+	proc(&ev)
+	AssertEqual(m, ev.Metric, 1.23)
+}
+
+func TestProcessorAttributes(m *testing.T) {
+	set := newTestProcessor(m, ProcessorConfig{Type: "set_attribute", Name: "a", Value: "1"})
+	remove := newTestProcessor(m, ProcessorConfig{Type: "remove_attribute", Name: "b"})
+
+	ev := raidman.Event{Attributes: map[string]string{"b": "2"}}
+	set(&ev)
+	remove(&ev)
+	AssertEqual(m, ev.Attributes["a"], "1")
+	AssertEqual(m, len(ev.Attributes), 1)
+
+	ev = raidman.Event{}
+	set(&ev)
+	AssertEqual(m, ev.Attributes["a"], "1")
+}
+
+func TestProcessorTags(m *testing.T) {
+	add := newTestProcessor(m, ProcessorConfig{Type: "add_tag", Tag: "new"})
+	remove := newTestProcessor(m, ProcessorConfig{Type: "remove_tag", Tag: "old"})
+
+	ev := raidman.Event{Tags: []string{"old", "kept"}}
+	add(&ev)
+	add(&ev)
+	remove(&ev)
+	AssertEqual(m, len(ev.Tags), 2)
+	AssertEqual(m, ev.Tags[0], "kept")
+	AssertEqual(m, ev.Tags[1], "new")
+}
+
+func TestProcessorParseMetric(m *testing.T) {
+	proc := newTestProcessor(m, ProcessorConfig{Type: "parse_metric"})
+
+	ev := raidman.Event{Metric: " 42.5 "}
+	proc(&ev)
+	AssertEqual(m, ev.Metric, 42.5)
+
+	ev = raidman.Event{Metric: "n/a"}
+	proc(&ev)
+	AssertEqual(m, ev.Metric, nil)
+
+	fromAttr := newTestProcessor(m, ProcessorConfig{Type: "parse_metric", Attribute: "value"})
+	ev = raidman.Event{Attributes: map[string]string{"value": "7"}}
+	fromAttr(&ev)
+	AssertEqual(m, ev.Metric, 7.0)
+}
+
+func TestProcessorsValidation(m *testing.T) {
+	bad := []ProcessorConfig{
+		{},
+		{Type: "unknown"},
+		{Type: "drop", Service: "("},
+		{Type: "rename", Service: "x"},
+		{Type: "scale"},
+		{Type: "round", Precision: -1},
+		{Type: "set_attribute"},
+		{Type: "remove_tag"},
+	}
+
+	for _, cfg := range bad {
+		if _, err := NewProcessor(cfg); err == nil {
+			m.Errorf("error expected for %+v", cfg)
+		}
+	}
+}
+
+func TestProcessorsOrder(m *testing.T) {
+	procs, err := NewProcessors([]ProcessorConfig{
+		{Type: "rename", Service: "^a$", To: "b"},
+		{Type: "drop", Service: "^b$"},
+	})
+	if err != nil {
+		m.Fatal(err)
+	}
+
+	AssertEqual(m, applyProcessors(procs, &raidman.Event{Service: "a"}), false)
+	AssertEqual(m, applyProcessors(procs, &raidman.Event{Service: "c"}), true)
+}
+
+func TestProcessorsBeforeThresholds(m *testing.T) {
+	dir := createDriversDir(m, map[string]string{
+		"a.yaml": `description: a
+module: fake
+service: "fake %tag"
+configuration: {attribute: x, value1: 2, value2: 0.5}
+processors:
+  - {type: scale, service: value1, factor: 1000}
+thresholds: {critical: 1000}
+`,
+	})
+
+	drivers := GetDrivers(testModules(), testConfiguration(dir))
+	AssertEqual(m, len(drivers), 1)
+
+	drv := drivers[0]
+	if err := drv.Start(); err != nil {
+		m.Fatal(err)
+	}
+	defer drv.Stop()
+
+	events, err := drv.Collect()
+	if err != nil {
+		m.Fatal(err)
+	}
+
+	// the thresholds see the scaled metric
+	AssertEqual(m, events[0].Metric, 2000.0)
+	AssertEqual(m, events[0].State, "critical")
+	AssertEqual(m, events[1].State, "ok")
+}
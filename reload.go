@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+
+	"github.com/avalente/riemann-agent/modules"
+)
+
+// driverHash fingerprints everything a driver is built from: its options
+// (as read from the file, or expanded for a target), the configuration
+// defaults and the module definition, including the executable file of
+// custom modules
+func driverHash(data []byte, defaults EventDefaults, mod modules.Module) string {
+	h := sha256.New()
+	h.Write(data)
+
+	// the callable of builtin modules can't change without a restart
+	moduleDef := struct {
+		Name       string
+		Kind       string
+		Parameters []modules.ModuleParameter
+		Executable string
+		// a changed executable restarts the module process
+		ModTime int64
+		Size    int64
+	}{Name: mod.Name, Kind: mod.Kind, Parameters: mod.Parameters, Executable: mod.Executable}
+
+	if mod.Executable != "" {
+		info, err := os.Stat(mod.Executable)
+		if err == nil {
+			moduleDef.ModTime = info.ModTime().UnixNano()
+			moduleDef.Size = info.Size()
+		}
+	}
+
+	extra, _ := json.Marshal([]interface{}{defaults, moduleDef})
+	h.Write(extra)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// diffDrivers compares the running drivers with the loaded ones, by file
+// and hash: the unchanged drivers keep running (with their state), the
+// removed and changed ones are stopped and the new and changed ones are
+// started
+func diffDrivers(running, loaded []*Driver) (keep, stop, start []*Driver) {
+	byId := map[string]*Driver{}
+	for _, drv := range loaded {
+		byId[drv.Id] = drv
+	}
+
+	kept := map[string]bool{}
+
+	for _, drv := range running {
+		newDrv, found := byId[drv.Id]
+		if found && newDrv.hash == drv.hash {
+			keep = append(keep, drv)
+			kept[drv.Id] = true
+		} else {
+			stop = append(stop, drv)
+		}
+	}
+
+	for _, drv := range loaded {
+		if !kept[drv.Id] {
+			start = append(start, drv)
+		}
+	}
+
+	return keep, stop, start
+}
+
+// senderChanged reports whether the connection to riemann must be reopened
+func senderChanged(old, cfg *Configuration) bool {
+	return old.RiemannHost != cfg.RiemannHost || old.RiemannProtocol != cfg.RiemannProtocol
+}
+
+// schedulerChanged reports whether the scheduler must be rebuilt
+func schedulerChanged(old, cfg *Configuration) bool {
+	return old.Workers != cfg.Workers || !reflect.DeepEqual(old.ModuleConcurrency, cfg.ModuleConcurrency) ||
+		old.Defaults.Host != cfg.Defaults.Host || old.Defaults.Ttl != cfg.Defaults.Ttl
+}
+
+// checkParameters returns the parameter errors of the drivers, otherwise
+// found only when the drivers are started
+func checkParameters(drivers []*Driver) []error {
+	errs := []error{}
+	for _, drv := range drivers {
+		_, err := GetParameters(*drv)
+		if err != "" {
+			errs = append(errs, fmt.Errorf("driver <%s>: %s", drv.Id, err))
+		}
+	}
+	return errs
+}
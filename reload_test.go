@@ -0,0 +1,160 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/avalente/riemann-agent/modules"
+)
+
+func driverIds(drivers []*Driver) string {
+	res := []string{}
+	for _, drv := range drivers {
+		res = append(res, filepath.Base(drv.Id))
+	}
+	return strings.Join(res, ",")
+}
+
+func TestDiffDrivers(m *testing.T) {
+	dir := createDriversDir(m, map[string]string{
+		"a.yaml": "description: a\nmodule: ping\n",
+		"b.yaml": "description: b\nmodule: ping\n",
+		"c.yaml": "description: c\nmodule: ping\n",
+	})
+	cfg := testConfiguration(dir)
+
+	running := GetDrivers(testModules(), cfg)
+	AssertEqual(m, len(running), 3)
+
+	err := ioutil.WriteFile(filepath.Join(dir, "b.yaml"), []byte("description: b\nmodule: ping\ninterval: 10\n"), 0644)
+	if err != nil {
+		m.Fatal(err)
+	}
+	os.Remove(filepath.Join(dir, "c.yaml"))
+	err = ioutil.WriteFile(filepath.Join(dir, "d.yaml"), []byte("description: d\nmodule: ping\n"), 0644)
+	if err != nil {
+		m.Fatal(err)
+	}
+
+	keep, stop, start := diffDrivers(running, GetDrivers(testModules(), cfg))
+
+	AssertEqual(m, driverIds(keep), "a.yaml")
+	AssertEqual(m, driverIds(stop), "b.yaml,c.yaml")
+	AssertEqual(m, driverIds(start), "b.yaml,d.yaml")
+
+	// the running drivers are kept, with their state
+	if keep[0] != running[0] {
+		m.Error("running driver not kept")
+	}
+}
+
+func TestDiffDriversDefaults(m *testing.T) {
+	dir := createDriversDir(m, map[string]string{
+		"a.yaml": "description: a\nmodule: ping\n",
+	})
+	cfg := testConfiguration(dir)
+
+	running := GetDrivers(testModules(), cfg)
+
+	cfg.Defaults.Tags = []string{"new"}
+	keep, stop, start := diffDrivers(running, GetDrivers(testModules(), cfg))
+
+	AssertEqual(m, len(keep), 0)
+	AssertEqual(m, len(stop), 1)
+	AssertEqual(m, len(start), 1)
+}
+
+func TestReloadSettingsChanged(m *testing.T) {
+	old := NewConfiguration()
+	cfg := NewConfiguration()
+
+	AssertEqual(m, senderChanged(old, cfg), false)
+	AssertEqual(m, schedulerChanged(old, cfg), false)
+
+	cfg.LogLevel = "debug"
+	cfg.DriversDirectory = "other"
+	AssertEqual(m, senderChanged(old, cfg), false)
+	AssertEqual(m, schedulerChanged(old, cfg), false)
+
+	cfg.RiemannProtocol = "tcp"
+	cfg.ModuleConcurrency = map[string]int{"ping": 1}
+	AssertEqual(m, senderChanged(old, cfg), true)
+	AssertEqual(m, schedulerChanged(old, cfg), true)
+}
+
+func testReloadState(configFile string) *AppState {
+	queue := make(ResQueue, 10)
+	cfg := NewConfiguration()
+	cfg.Defaults.Host = "agent-host"
+	return &AppState{cmdLine: CmdlineArgs{configFile, false, "<none>"}, resChannel: &queue, configuration: cfg}
+}
+
+func TestReloadKeepsRunningConfiguration(m *testing.T) {
+	dir := createDriversDir(m, map[string]string{
+		"a.yaml": "description: a\nmodule: ping\nconfiguration: {target: localhost}\n",
+		"b.yaml": "description: b\nmodule: ping\n",
+	})
+
+	setAgentHostname("agent-host")
+	defer setAgentHostname("")
+
+	for _, content := range []string{
+		`{"RiemannProtocol": "tcp"`,
+		`{"DriversDirectory": "` + dir + `", "Defaults": {"Host": "h"}}`,
+	} {
+		state := testReloadState(createCF(ctx, content))
+		running := state.configuration
+
+		reload(state)
+
+		if state.configuration != running {
+			m.Errorf("running configuration replaced by %s", content)
+		}
+
+		ev := <-*state.resChannel
+		AssertEqual(m, ev.Service, ReloadService)
+		AssertEqual(m, ev.State, "critical")
+		AssertEqual(m, ev.Host, "agent-host")
+		AssertEqual(m, agentHostname(), "agent-host")
+	}
+}
+
+func TestCheckParameters(m *testing.T) {
+	dir := createDriversDir(m, map[string]string{
+		"a.yaml": "description: a\nmodule: ping\nconfiguration: {target: localhost}\n",
+		"b.yaml": "description: b\nmodule: ping\n",
+		"c.yaml": "description: c\nmodule: ping\nconfiguration: {target: 1}\n",
+	})
+
+	errs := checkParameters(GetDrivers(testModules(), testConfiguration(dir)))
+	AssertEqual(m, len(errs), 2)
+}
+
+func TestDiffDriversExecutableChanged(m *testing.T) {
+	modulesDir := createModulesDir(m, map[string]string{
+		"check": "name: check\nkind: executable\n",
+	})
+	dir := createDriversDir(m, map[string]string{
+		"a.yaml": "description: a\nmodule: check\n",
+	})
+	cfg := testConfiguration(dir)
+
+	running := GetDrivers(modules.ScanModules(modulesDir), cfg)
+	AssertEqual(m, len(running), 1)
+
+	keep, _, _ := diffDrivers(running, GetDrivers(modules.ScanModules(modulesDir), cfg))
+	AssertEqual(m, driverIds(keep), "a.yaml")
+
+	err := ioutil.WriteFile(filepath.Join(modulesDir, "check", "check"), []byte("#!/bin/sh\necho new\n"), 0755)
+	if err != nil {
+		m.Fatal(err)
+	}
+
+	keep, stop, start := diffDrivers(running, GetDrivers(modules.ScanModules(modulesDir), cfg))
+	AssertEqual(m, len(keep), 0)
+	AssertEqual(m, driverIds(stop), "a.yaml")
+	AssertEqual(m, driverIds(start), "a.yaml")
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+
+	"github.com/amir/raidman"
+
+	"github.com/avalente/riemann-agent/modules"
+)
+
+// driverRunner executes the module of a driver
+type driverRunner interface {
+	Start() error
+	Run() (modules.EventList, error)
+	Stop()
+}
+
+func newRunner(drv *Driver, params modules.ModuleParamList) (driverRunner, error) {
+	switch drv.ModuleObject.Kind {
+	case "builtin":
+		return &builtinRunner{drv.ModuleObject.Callable, params}, nil
+	case "executable":
+		return &executableRunner{drv: drv, params: params}, nil
+	}
+	return nil, fmt.Errorf("unknown module kind: %s", drv.ModuleObject.Kind)
+}
+
+type builtinRunner struct {
+	callable modules.ModuleCallable
+	params   modules.ModuleParamList
+}
+
+func (r *builtinRunner) Start() error {
+	return nil
+}
+
+func (r *builtinRunner) Run() (modules.EventList, error) {
+	return r.callable(r.params), nil
+}
+
+func (r *builtinRunner) Stop() {
+}
+
+// executableRunner talks to the external process of a custom module: it
+// is started with the driver and asked for events on every run
+type executableRunner struct {
+	drv    *Driver
+	params modules.ModuleParamList
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+}
+
+func (r *executableRunner) Start() error {
+	var err error
+
+	r.cmd = exec.Command(r.drv.ModuleObject.Executable)
+
+	r.stdin, err = r.cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("can't get stdin (%v)", err)
+	}
+
+	r.stdout, err = r.cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("can't get stdout (%v)", err)
+	}
+
+	return r.cmd.Start()
+}
+
+func readInt(reader io.Reader) (int64, error) {
+	// string representation of four-digit integer (0001-9999)
+	countBuf := make([]byte, 4)
+	_, err := io.ReadFull(reader, countBuf)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(countBuf), 10, 0)
+}
+
+func (r *executableRunner) Run() (modules.EventList, error) {
+	paramsJson, _ := json.Marshal(r.params)
+
+	in_ := append([]byte("call "), paramsJson...)
+	in_ = append(in_, '\n')
+	_, err := r.stdin.Write(in_)
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := readInt(r.stdout)
+	if err != nil {
+		return nil, err
+	}
+
+	events := modules.EventList{}
+
+	for i := 0; i < int(count); i++ {
+		size, err := readInt(r.stdout)
+		if err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, size)
+		_, err = io.ReadFull(r.stdout, buf)
+		if err != nil {
+			return nil, err
+		}
+
+		ev := raidman.Event{}
+
+		decoder := json.NewDecoder(bytes.NewReader(buf))
+		err = decoder.Decode(&ev)
+		if err != nil {
+			return nil, err
+		}
+
+		err = normalizeMetric(&ev)
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, &ev)
+	}
+
+	return events, nil
+}
+
+func (r *executableRunner) Stop() {
+	if r.cmd == nil || r.cmd.Process == nil {
+		return
+	}
+	r.stdin.Write([]byte("exit"))
+	r.stdin.Close()
+	r.cmd.Wait()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// compileSchedule checks the schedule options of the driver, parsing the
+// cron expression if any
+func (drv *Driver) compileSchedule() error {
+	if drv.Cron == "" {
+		return nil
+	}
+
+	if drv.Align {
+		return fmt.Errorf("cron and align can't be used together")
+	}
+
+	schedule, err := cron.ParseStandard(drv.Cron)
+	if err != nil {
+		return fmt.Errorf("bad cron expression %s: %v", drv.Cron, err)
+	}
+	if schedule.Next(time.Now()).IsZero() {
+		return fmt.Errorf("cron expression %s never fires", drv.Cron)
+	}
+	drv.cronSchedule = schedule
+
+	return nil
+}
+
+// splayOffset returns a deterministic offset in [0, interval) for the
+// driver, so that drivers (and agents) with the same interval don't fire
+// at the same time
+func (drv *Driver) splayOffset(interval time.Duration) time.Duration {
+	if interval <= 0 {
+		return 0
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(agentHostname()))
+	h.Write([]byte{0})
+	h.Write([]byte(drv.Id))
+
+	return time.Duration(h.Sum64() % uint64(interval))
+}
+
+func (drv *Driver) interval() time.Duration {
+	return time.Duration(drv.Interval) * time.Second
+}
+
+// firstRun returns the time of the first run of the driver, without jitter
+// (and without considering RunOnStart). Splay applies only to the plain
+// interval schedules, since aligned and cron ones follow the wall clock.
+func (drv *Driver) firstRun(now time.Time) time.Time {
+	switch {
+	case drv.cronSchedule != nil, drv.Align:
+		return drv.nextRun(now)
+	case drv.Splay:
+		return now.Add(drv.splayOffset(drv.interval()))
+	}
+	return now.Add(drv.interval())
+}
+
+// nextRun returns the time of the run following the one scheduled at the
+// given time, without jitter
+func (drv *Driver) nextRun(scheduled time.Time) time.Time {
+	switch {
+	case drv.cronSchedule != nil:
+		return drv.cronSchedule.Next(scheduled)
+	case drv.Align:
+		return alignedAfter(scheduled, drv.interval())
+	}
+	return scheduled.Add(drv.interval())
+}
+
+// alignedAfter returns the first wall-clock multiple of interval after t,
+// in the location of t (Truncate alone would align on UTC, so a 1h
+// interval would fire at :30 in a +05:30 zone)
+func alignedAfter(t time.Time, interval time.Duration) time.Time {
+	_, offset := t.Zone()
+	zone := time.Duration(offset) * time.Second
+	return t.Add(zone).Truncate(interval).Add(interval).Add(-zone)
+}
+
+// jitter returns a random delay in [0, Jitter) seconds
+func (drv *Driver) jitter() time.Duration {
+	if drv.Jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(time.Duration(drv.Jitter) * time.Second)))
+}
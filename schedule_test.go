@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSplayOffset(m *testing.T) {
+	a := Driver{Id: "/etc/riemann-agent/drivers/a.json", Interval: 30}
+	b := Driver{Id: "/etc/riemann-agent/drivers/b.json", Interval: 30}
+
+	offset := a.splayOffset(a.interval())
+	if offset < 0 || offset >= 30*time.Second {
+		m.Errorf("offset out of range: %v", offset)
+	}
+
+	// deterministic
+	AssertEqual(m, a.splayOffset(a.interval()), offset)
+
+	if b.splayOffset(b.interval()) == offset {
+		m.Errorf("same offset for different drivers: %v", offset)
+	}
+}
+
+func TestFirstRun(m *testing.T) {
+	now := time.Now()
+
+	drv := Driver{Id: "a", Interval: 30}
+	AssertEqual(m, drv.firstRun(now), now.Add(30*time.Second))
+
+	drv.Splay = true
+	AssertEqual(m, drv.firstRun(now), now.Add(drv.splayOffset(30*time.Second)))
+
+	AssertEqual(m, drv.nextRun(now), now.Add(30*time.Second))
+}
+
+func TestJitter(m *testing.T) {
+	drv := Driver{Interval: 30}
+	AssertEqual(m, drv.jitter(), time.Duration(0))
+
+	drv.Jitter = 2
+	for i := 0; i < 100; i++ {
+		if j := drv.jitter(); j < 0 || j >= 2*time.Second {
+			m.Fatalf("jitter out of range: %v", j)
+		}
+	}
+}
+
+func TestAlignedSchedule(m *testing.T) {
+	drv := Driver{Interval: 60, Align: true, Splay: true}
+	now := time.Date(2016, 3, 1, 10, 20, 35, 0, time.UTC)
+
+	AssertEqual(m, drv.firstRun(now), time.Date(2016, 3, 1, 10, 21, 0, 0, time.UTC))
+	AssertEqual(m, drv.nextRun(drv.firstRun(now)), time.Date(2016, 3, 1, 10, 22, 0, 0, time.UTC))
+}
+
+func TestAlignedScheduleLocalTime(m *testing.T) {
+	kolkata := time.FixedZone("IST", 5*3600+1800)
+
+	drv := Driver{Interval: 3600, Align: true}
+	now := time.Date(2016, 3, 1, 10, 20, 35, 0, kolkata)
+	AssertEqual(m, drv.firstRun(now).Equal(time.Date(2016, 3, 1, 11, 0, 0, 0, kolkata)), true)
+
+	drv = Driver{Interval: 86400, Align: true}
+	AssertEqual(m, drv.firstRun(now).Equal(time.Date(2016, 3, 2, 0, 0, 0, 0, kolkata)), true)
+}
+
+func TestCronSchedule(m *testing.T) {
+	drv := Driver{Cron: "*/15 * * * *"}
+	if err := drv.compileSchedule(); err != nil {
+		m.Fatal(err)
+	}
+
+	now := time.Date(2016, 3, 1, 10, 20, 35, 0, time.Local)
+	first := drv.firstRun(now)
+	AssertEqual(m, first, time.Date(2016, 3, 1, 10, 30, 0, 0, time.Local))
+	AssertEqual(m, drv.nextRun(first), time.Date(2016, 3, 1, 10, 45, 0, 0, time.Local))
+
+	for _, bad := range []Driver{{Cron: "* * *"}, {Cron: "@hourly", Align: true}, {Cron: "0 0 30 2 *"}} {
+		if bad.compileSchedule() == nil {
+			m.Errorf("error expected for %+v", bad)
+		}
+	}
+}
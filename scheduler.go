@@ -0,0 +1,386 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/amir/raidman"
+)
+
+// SkippedRunsService is the service of the events reporting the runs
+// skipped because the previous run of the same driver was still going on
+const SkippedRunsService = "riemann-agent skipped runs"
+
+// scheduleEntry is a driver in the scheduler queue
+type scheduleEntry struct {
+	drv *Driver
+	// scheduled time of the next run, without jitter
+	scheduled time.Time
+	// actual time of the next run
+	at time.Time
+	// the next run is the run on start
+	onStart bool
+	// dispatched, or waiting for the concurrency limit of its module
+	running bool
+	waiting bool
+	removed bool
+	// closed when the running run is over
+	idle  chan struct{}
+	index int
+}
+
+// scheduleQueue is a priority queue of entries ordered by next run time
+type scheduleQueue []*scheduleEntry
+
+func (q scheduleQueue) Len() int           { return len(q) }
+func (q scheduleQueue) Less(i, j int) bool { return q[i].at.Before(q[j].at) }
+
+func (q scheduleQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *scheduleQueue) Push(x interface{}) {
+	e := x.(*scheduleEntry)
+	e.index = len(*q)
+	*q = append(*q, e)
+}
+
+func (q *scheduleQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	e.index = -1
+	*q = old[:len(old)-1]
+	return e
+}
+
+// Scheduler runs the drivers at their scheduled times on a bounded pool
+// of workers. A run due while the previous run of the same driver is still
+// going on is skipped and counted. The runs of a module over its
+// concurrency limit wait for their turn without taking a worker.
+type Scheduler struct {
+	sync.Mutex
+	clock   Clock
+	queue   ResQueue
+	alerter *Alerter
+	host    string
+	ttl     float32
+
+	entries scheduleQueue
+	drivers map[*Driver]*scheduleEntry
+	// concurrency limits, running runs and runs waiting, by module
+	limits  map[string]int
+	active  map[string]int
+	waiting map[string][]*scheduleEntry
+	skipped int64
+
+	jobs chan *scheduleEntry
+	wake chan struct{}
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// jobs waiting for a free worker, at most
+const schedulerBacklog = 1024
+
+func NewScheduler(clock Clock, cfg *Configuration, queue ResQueue, alerter *Alerter) *Scheduler {
+	s := &Scheduler{
+		clock:   clock,
+		queue:   queue,
+		alerter: alerter,
+		host:    cfg.Defaults.Host,
+		ttl:     cfg.Defaults.Ttl,
+		drivers: map[*Driver]*scheduleEntry{},
+		limits:  map[string]int{},
+		active:  map[string]int{},
+		waiting: map[string][]*scheduleEntry{},
+		jobs:    make(chan *scheduleEntry, schedulerBacklog),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+
+	for module, limit := range cfg.ModuleConcurrency {
+		s.limits[module] = limit
+	}
+
+	workers := cfg.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	for i := 0; i < workers; i++ {
+		s.wg.Add(1)
+		go s.worker()
+	}
+
+	s.wg.Add(1)
+	go s.loop()
+
+	return s
+}
+
+// Add starts the driver and schedules its runs
+func (s *Scheduler) Add(drv *Driver) {
+	drv.alerter = s.alerter
+
+	err := drv.Start()
+	if err != nil {
+		log.Error("Can't run driver %s: %s - DRIVER DISABLED", drv.Id, err)
+		return
+	}
+
+	now := s.clock.Now()
+	e := &scheduleEntry{drv: drv, scheduled: drv.firstRun(now), onStart: drv.RunOnStart, idle: make(chan struct{})}
+	close(e.idle)
+	if e.onStart {
+		e.at = now
+	} else {
+		e.at = e.scheduled.Add(drv.jitter())
+	}
+
+	s.Lock()
+	s.drivers[drv] = e
+	heap.Push(&s.entries, e)
+	s.Unlock()
+
+	s.notify()
+}
+
+// Remove unschedules the driver and stops it, after waiting for the
+// running run, if any
+func (s *Scheduler) Remove(drv *Driver) {
+	s.Lock()
+	e, found := s.drivers[drv]
+	if !found {
+		s.Unlock()
+		return
+	}
+	s.unschedule(e)
+	idle := e.idle
+	s.Unlock()
+
+	<-idle
+	drv.Stop()
+}
+
+// unschedule removes the entry from the queue; it must be called with
+// the lock held
+func (s *Scheduler) unschedule(e *scheduleEntry) {
+	e.removed = true
+	delete(s.drivers, e.drv)
+	if e.index >= 0 {
+		heap.Remove(&s.entries, e.index)
+	}
+
+	if e.waiting {
+		module := e.drv.Module
+		for i, w := range s.waiting[module] {
+			if w == e {
+				s.waiting[module] = append(s.waiting[module][:i], s.waiting[module][i+1:]...)
+				break
+			}
+		}
+		e.waiting = false
+		e.running = false
+		close(e.idle)
+	}
+}
+
+// Drivers returns the scheduled drivers
+func (s *Scheduler) Drivers() []*Driver {
+	s.Lock()
+	defer s.Unlock()
+
+	res := make([]*Driver, 0, len(s.drivers))
+	for drv := range s.drivers {
+		res = append(res, drv)
+	}
+	return res
+}
+
+// Skipped returns the number of runs skipped so far
+func (s *Scheduler) Skipped() int64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.skipped
+}
+
+// Stop terminates the scheduler and all the drivers
+func (s *Scheduler) Stop() {
+	for _, drv := range s.Drivers() {
+		s.Remove(drv)
+	}
+
+	close(s.done)
+	s.wg.Wait()
+}
+
+func (s *Scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Scheduler) loop() {
+	defer s.wg.Done()
+
+	for {
+		var timeout <-chan time.Time
+		var timer Timer
+
+		s.Lock()
+		now := s.clock.Now()
+		for len(s.entries) > 0 && !s.entries[0].at.After(now) {
+			e := s.entries[0]
+			s.dispatch(e)
+			s.reschedule(e, now)
+			heap.Fix(&s.entries, e.index)
+		}
+		if len(s.entries) > 0 {
+			timer = s.clock.NewTimer(s.entries[0].at.Sub(now))
+			timeout = timer.C()
+		}
+		s.Unlock()
+
+		select {
+		case <-timeout:
+		case <-s.wake:
+		case <-s.done:
+			if timer != nil {
+				timer.Stop()
+			}
+			close(s.jobs)
+			return
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// dispatch hands the run over to the workers, unless the previous one is
+// still going on; if its module is at the concurrency limit, the run
+// waits for a run of the same module to end. It must be called with the
+// lock held.
+func (s *Scheduler) dispatch(e *scheduleEntry) {
+	if e.running {
+		s.skip(e, "previous run still in progress")
+		return
+	}
+
+	module := e.drv.Module
+	if s.limitReached(module) {
+		e.running = true
+		e.waiting = true
+		e.idle = make(chan struct{})
+		s.waiting[module] = append(s.waiting[module], e)
+		return
+	}
+
+	select {
+	case s.jobs <- e:
+		e.running = true
+		e.idle = make(chan struct{})
+		s.active[module]++
+	default:
+		s.skip(e, "no worker available")
+	}
+}
+
+func (s *Scheduler) limitReached(module string) bool {
+	limit, found := s.limits[module]
+	return found && s.active[module] >= limit
+}
+
+// dispatchWaiting hands the waiting runs of the module over to the
+// workers, within its concurrency limit; it must be called with the lock
+// held
+func (s *Scheduler) dispatchWaiting(module string) {
+	for len(s.waiting[module]) > 0 && !s.limitReached(module) {
+		e := s.waiting[module][0]
+		s.waiting[module] = s.waiting[module][1:]
+		e.waiting = false
+
+		select {
+		case s.jobs <- e:
+			s.active[module]++
+		default:
+			e.running = false
+			close(e.idle)
+			s.skip(e, "no worker available")
+		}
+	}
+}
+
+func (s *Scheduler) skip(e *scheduleEntry, reason string) {
+	s.skipped++
+	log.Warning("Skipping run of driver %s: %s", e.drv.Id, reason)
+
+	ev := &raidman.Event{
+		Host:        s.host,
+		Service:     SkippedRunsService,
+		State:       "warning",
+		Metric:      s.skipped,
+		Description: fmt.Sprintf("run of driver %s skipped: %s", e.drv.Id, reason),
+		Attributes:  map[string]string{"driver": e.drv.Id},
+		Ttl:         s.ttl,
+		Time:        s.clock.Now().Unix(),
+	}
+
+	select {
+	case s.queue <- ev:
+	default:
+		log.Warning("Results queue full, skipped runs event dropped")
+	}
+}
+
+// reschedule computes the next run of the entry, skipping the ones already
+// missed; it must be called with the lock held
+func (s *Scheduler) reschedule(e *scheduleEntry, now time.Time) {
+	if e.onStart {
+		e.onStart = false
+	} else {
+		e.scheduled = e.drv.nextRun(e.scheduled)
+		for !e.scheduled.After(now) {
+			e.scheduled = e.drv.nextRun(e.scheduled)
+		}
+	}
+	e.at = e.scheduled.Add(e.drv.jitter())
+}
+
+func (s *Scheduler) worker() {
+	defer s.wg.Done()
+
+	for e := range s.jobs {
+		s.Lock()
+		removed := e.removed
+		s.Unlock()
+
+		var err error
+		if !removed {
+			err = e.drv.Run(s.queue)
+		}
+
+		s.Lock()
+		s.active[e.drv.Module]--
+		disable := err != nil && !e.removed
+		if disable {
+			log.Error("Can't run driver %s on module %s: %s - DRIVER DISABLED", e.drv.Id, e.drv.Module, err)
+			s.unschedule(e)
+		}
+		e.running = false
+		close(e.idle)
+		s.dispatchWaiting(e.drv.Module)
+		s.Unlock()
+
+		if disable {
+			e.drv.Stop()
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amir/raidman"
+
+	"github.com/avalente/riemann-agent/modules"
+)
+
+// fakeClock is a Clock whose time only moves on Advance
+type fakeClock struct {
+	sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock   *fakeClock
+	at      time.Time
+	c       chan time.Time
+	stopped bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2016, 3, 1, 10, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	c.Lock()
+	defer c.Unlock()
+
+	t := &fakeTimer{clock: c, at: c.now.Add(d), c: make(chan time.Time, 1)}
+	c.timers = append(c.timers, t)
+	c.fire()
+	return t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.now = c.now.Add(d)
+	c.fire()
+}
+
+func (c *fakeClock) fire() {
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		switch {
+		case t.stopped:
+		case !t.at.After(c.now):
+			t.c <- c.now
+		default:
+			pending = append(pending, t)
+		}
+	}
+	c.timers = pending
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+	t.stopped = true
+	return true
+}
+
+func schedulerDriver(id string, interval int, callable modules.ModuleCallable) *Driver {
+	return &Driver{Id: id, Service: id, Module: "test", Interval: interval, Ttl: 60,
+		ModuleObject: modules.Module{Name: "test", Kind: "builtin", Callable: callable}}
+}
+
+func metricEvent(params modules.ModuleParamList) modules.EventList {
+	return modules.EventList{&raidman.Event{Metric: 1}}
+}
+
+func expectEvent(m *testing.T, queue ResQueue, service string) *raidman.Event {
+	select {
+	case ev := <-queue:
+		AssertEqual(m, ev.Service, service)
+		return ev
+	case <-time.After(time.Second):
+		m.Fatalf("event expected for %s", service)
+	}
+	return nil
+}
+
+func expectNoEvent(m *testing.T, queue ResQueue) {
+	select {
+	case ev := <-queue:
+		m.Fatalf("no event expected, got %+v", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSchedulerRuns(m *testing.T) {
+	clock := newFakeClock()
+	queue := make(ResQueue, 10)
+	s := NewScheduler(clock, NewConfiguration(), queue, nil)
+	defer s.Stop()
+
+	s.Add(schedulerDriver("a", 10, metricEvent))
+	s.Add(schedulerDriver("b", 25, metricEvent))
+
+	expectNoEvent(m, queue)
+
+	clock.Advance(10 * time.Second)
+	expectEvent(m, queue, "a")
+	expectNoEvent(m, queue)
+
+	clock.Advance(10 * time.Second)
+	expectEvent(m, queue, "a")
+
+	clock.Advance(5 * time.Second)
+	expectEvent(m, queue, "b")
+	expectNoEvent(m, queue)
+
+	AssertEqual(m, len(s.Drivers()), 2)
+}
+
+func TestSchedulerRunOnStart(m *testing.T) {
+	clock := newFakeClock()
+	queue := make(ResQueue, 10)
+	s := NewScheduler(clock, NewConfiguration(), queue, nil)
+	defer s.Stop()
+
+	drv := schedulerDriver("a", 3600, metricEvent)
+	drv.RunOnStart = true
+	s.Add(drv)
+
+	expectEvent(m, queue, "a")
+
+	clock.Advance(time.Minute)
+	expectNoEvent(m, queue)
+
+	clock.Advance(59 * time.Minute)
+	expectEvent(m, queue, "a")
+}
+
+func TestSchedulerSkipsOverlappedRuns(m *testing.T) {
+	clock := newFakeClock()
+	queue := make(ResQueue, 10)
+	cfg := NewConfiguration()
+	cfg.Defaults.Host = "agent-host"
+	s := NewScheduler(clock, cfg, queue, nil)
+	defer s.Stop()
+
+	started := make(chan string, 10)
+	release := make(chan bool)
+	s.Add(blockingDriver("slow", "test", started, release))
+
+	clock.Advance(10 * time.Second)
+	expectStarted(m, started)
+
+	clock.Advance(10 * time.Second)
+	ev := expectEvent(m, queue, SkippedRunsService)
+	AssertEqual(m, ev.Host, "agent-host")
+	AssertEqual(m, ev.Metric, int64(1))
+	AssertEqual(m, ev.Attributes["driver"], "slow")
+
+	release <- true
+	expectEvent(m, queue, "slow")
+
+	clock.Advance(10 * time.Second)
+	expectStarted(m, started)
+	release <- true
+	expectEvent(m, queue, "slow")
+
+	AssertEqual(m, s.Skipped(), int64(1))
+}
+
+// blockingCallable signals each run on started and ends it on release
+func blockingCallable(started chan string, release chan bool) func(params modules.ModuleParamList) modules.EventList {
+	return func(params modules.ModuleParamList) modules.EventList {
+		started <- params["id"].(string)
+		<-release
+		return metricEvent(params)
+	}
+}
+
+func blockingDriver(id string, module string, started chan string, release chan bool) *Driver {
+	drv := schedulerDriver(id, 10, blockingCallable(started, release))
+	drv.Module = module
+	drv.ModuleObject.Parameters = []modules.ModuleParameter{{Name: "id", Type: "string", Default: id}}
+	return drv
+}
+
+func expectStarted(m *testing.T, started chan string) string {
+	select {
+	case id := <-started:
+		return id
+	case <-time.After(time.Second):
+		m.Fatal("run expected")
+	}
+	return ""
+}
+
+func expectNotStarted(m *testing.T, started chan string) {
+	select {
+	case id := <-started:
+		m.Fatalf("no run expected, %s started", id)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSchedulerModuleConcurrency(m *testing.T) {
+	clock := newFakeClock()
+	queue := make(ResQueue, 10)
+	cfg := NewConfiguration()
+	cfg.ModuleConcurrency = map[string]int{"test": 1}
+	s := NewScheduler(clock, cfg, queue, nil)
+	defer s.Stop()
+
+	started := make(chan string, 10)
+	release := make(chan bool)
+	for _, id := range []string{"a", "b", "c"} {
+		s.Add(blockingDriver(id, "test", started, release))
+	}
+
+	clock.Advance(10 * time.Second)
+	for i := 0; i < 3; i++ {
+		expectStarted(m, started)
+		expectNotStarted(m, started)
+		release <- true
+		<-queue
+	}
+
+	AssertEqual(m, s.Skipped(), int64(0))
+}
+
+func TestSchedulerModuleConcurrencyKeepsWorkers(m *testing.T) {
+	clock := newFakeClock()
+	queue := make(ResQueue, 10)
+	cfg := NewConfiguration()
+	cfg.Workers = 2
+	cfg.ModuleConcurrency = map[string]int{"test": 1}
+	s := NewScheduler(clock, cfg, queue, nil)
+	defer s.Stop()
+
+	started := make(chan string, 10)
+	release := map[string]chan bool{}
+	for _, id := range []string{"a", "b", "c", "other"} {
+		module := "test"
+		if id == "other" {
+			module = "other"
+		}
+		release[id] = make(chan bool)
+		s.Add(blockingDriver(id, module, started, release[id]))
+	}
+
+	// the waiting runs of the limited module don't hold the second worker
+	clock.Advance(10 * time.Second)
+	ids := []string{expectStarted(m, started), expectStarted(m, started)}
+	sort.Strings(ids)
+	AssertEqual(m, ids[1], "other")
+	expectNotStarted(m, started)
+
+	release["other"] <- true
+	<-queue
+
+	running := ids[0]
+	for i := 0; i < 2; i++ {
+		release[running] <- true
+		<-queue
+		running = expectStarted(m, started)
+	}
+	release[running] <- true
+	<-queue
+
+	AssertEqual(m, s.Skipped(), int64(0))
+}
+
+func TestSchedulerDisablesBadDrivers(m *testing.T) {
+	clock := newFakeClock()
+	queue := make(ResQueue, 10)
+	s := NewScheduler(clock, NewConfiguration(), queue, nil)
+	defer s.Stop()
+
+	drv := schedulerDriver("a", 10, metricEvent)
+	drv.ModuleObject.Parameters = []modules.ModuleParameter{{Name: "target", Type: "string", Required: true}}
+	s.Add(drv)
+
+	AssertEqual(m, len(s.Drivers()), 0)
+}
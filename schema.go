@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/avalente/riemann-agent/modules"
+)
+
+const jsonSchemaVersion = "http://json-schema.org/draft-07/schema#"
+
+// durationPattern matches the strings accepted by time.ParseDuration
+const durationPattern = `^([0-9]+(\.[0-9]*)?(ns|us|µs|ms|s|m|h))+$`
+
+type jsonSchema map[string]interface{}
+
+// fieldKey returns the key of the struct field in the files: the json tag
+// if any, otherwise the lower case name (keys are matched regardless of
+// case)
+func fieldKey(field reflect.StructField) string {
+	tag := strings.Split(field.Tag.Get("json"), ",")[0]
+	if tag != "" {
+		return tag
+	}
+	return strings.ToLower(field.Name)
+}
+
+// keyPattern matches the key regardless of case, as the agent does when
+// decoding the files
+func keyPattern(key string) string {
+	var b strings.Builder
+
+	b.WriteString("^")
+	for _, r := range key {
+		lower, upper := unicode.ToLower(r), unicode.ToUpper(r)
+		if lower != upper {
+			fmt.Fprintf(&b, "[%c%c]", upper, lower)
+		} else {
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+
+	return b.String()
+}
+
+// requiredKey requires the key regardless of case, since "required" is
+// case-sensitive: not all the property names differ from the key
+func requiredKey(key string) jsonSchema {
+	return jsonSchema{"not": jsonSchema{"propertyNames": jsonSchema{"not": jsonSchema{"pattern": keyPattern(key)}}}}
+}
+
+// typeSchema describes the Go type as decoded from the configuration files;
+// the struct keys are listed as properties, with their canonical name, and
+// matched regardless of case by the pattern properties
+func typeSchema(t reflect.Type) jsonSchema {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem())
+	case reflect.Bool:
+		return jsonSchema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return jsonSchema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return jsonSchema{"type": "number"}
+	case reflect.String:
+		return jsonSchema{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return jsonSchema{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return jsonSchema{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Struct:
+		properties := jsonSchema{}
+		structProperties(t, properties)
+		return jsonSchema{"type": "object", "properties": properties,
+			"patternProperties": patternProperties(properties), "additionalProperties": false}
+	}
+	return jsonSchema{}
+}
+
+func structProperties(t reflect.Type, properties jsonSchema) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		// embedded structs are flattened by encoding/json
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			structProperties(field.Type, properties)
+			continue
+		}
+
+		if field.PkgPath != "" || field.Tag.Get("json") == "-" {
+			continue
+		}
+
+		properties[fieldKey(field)] = typeSchema(field.Type)
+	}
+}
+
+func patternProperties(properties jsonSchema) jsonSchema {
+	res := jsonSchema{}
+	for key, schema := range properties {
+		res[keyPattern(key)] = schema
+	}
+	return res
+}
+
+// parameterSchema describes the values accepted for the module parameter
+func parameterSchema(param modules.ModuleParameter) jsonSchema {
+	schema := jsonSchema{}
+
+	switch param.Type {
+	case modules.TypeBool:
+		schema["type"] = "boolean"
+	case modules.TypeString:
+		schema["type"] = "string"
+	case modules.TypeNumber, modules.TypeFloat:
+		schema["type"] = "number"
+	case modules.TypeInteger:
+		schema["type"] = "integer"
+	case modules.TypeDuration:
+		schema["type"] = "string"
+		schema["pattern"] = durationPattern
+	case modules.TypeList:
+		schema["type"] = "array"
+		if param.Items != nil {
+			schema["items"] = parameterSchema(*param.Items)
+		}
+	case modules.TypeMap:
+		schema["type"] = "object"
+		if len(param.Fields) > 0 {
+			schema["properties"], schema["required"] = parametersSchema(param.Fields)
+			schema["additionalProperties"] = false
+		}
+	}
+
+	if param.Description != "" {
+		schema["description"] = param.Description
+	}
+	if param.Default != nil {
+		schema["default"] = param.Default
+	}
+	if len(param.Enum) > 0 {
+		schema["enum"] = param.Enum
+	}
+	if param.Pattern != "" {
+		schema["pattern"] = param.Pattern
+	}
+	if param.Type != modules.TypeDuration {
+		if param.Min != nil {
+			schema["minimum"] = *param.Min
+		}
+		if param.Max != nil {
+			schema["maximum"] = *param.Max
+		}
+	}
+
+	return schema
+}
+
+func parametersSchema(params []modules.ModuleParameter) (jsonSchema, []string) {
+	properties := jsonSchema{}
+	required := []string{}
+
+	for _, param := range params {
+		properties[param.Name] = parameterSchema(param)
+		if param.Required {
+			required = append(required, param.Name)
+		}
+	}
+
+	return properties, required
+}
+
+// ModuleSchema describes the configuration of the drivers of the module;
+// like GetParameters, it allows keys not declared by the module
+func ModuleSchema(mod modules.Module) jsonSchema {
+	properties, required := parametersSchema(mod.Parameters)
+	return jsonSchema{"type": "object", "properties": properties, "required": required}
+}
+
+// DriverSchema describes the driver files; the configuration is checked
+// against the schema of the module named in the file
+func DriverSchema(availableModules map[string]modules.Module) jsonSchema {
+	names := []string{}
+	for name := range availableModules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	schema := typeSchema(reflect.TypeOf(Driver{}))
+	properties := schema["properties"].(jsonSchema)
+	properties["id"] = jsonSchema{"type": "string", "description": "Ignored, the id is the file name"}
+	properties["module"] = jsonSchema{"type": "string", "enum": names}
+	properties["configuration"] = jsonSchema{"type": "object"}
+
+	conditions := []jsonSchema{requiredKey("description"), requiredKey("module")}
+	for alias, name := range driverKeyAliases {
+		name = strings.ToLower(name)
+		properties[alias] = properties[name]
+		conditions = append(conditions, jsonSchema{"not": jsonSchema{"allOf": []jsonSchema{requiredKey(alias), requiredKey(name)}}})
+	}
+
+	schema["$schema"] = jsonSchemaVersion
+	schema["title"] = "riemann-agent driver"
+	schema["patternProperties"] = patternProperties(properties)
+
+	for _, name := range names {
+		configuration := ModuleSchema(availableModules[name])
+		then := jsonSchema{"patternProperties": jsonSchema{keyPattern("configuration"): configuration}}
+		if len(configuration["required"].([]string)) > 0 {
+			then["allOf"] = []jsonSchema{requiredKey("configuration")}
+		}
+
+		conditions = append(conditions, jsonSchema{
+			"if":   jsonSchema{"patternProperties": jsonSchema{keyPattern("module"): jsonSchema{"const": name}}},
+			"then": then,
+		})
+	}
+	schema["allOf"] = conditions
+
+	return schema
+}
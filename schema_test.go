@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/avalente/riemann-agent/cfgfile"
+	"github.com/avalente/riemann-agent/modules"
+)
+
+func TestDriverSchema(m *testing.T) {
+	schema := DriverSchema(testModules())
+
+	AssertEqual(m, schema["type"], "object")
+	AssertEqual(m, schema["additionalProperties"], false)
+
+	properties := schema["properties"].(jsonSchema)
+	for _, key := range []string{"description", "module", "interval", "service", "tags", "ttl", "configuration",
+		"runonstart", "run_on_start", "onchange", "on_change", "mergepolicy", "thresholds", "processors"} {
+		if properties[key] == nil {
+			m.Errorf("missing property %s", key)
+		}
+	}
+	for _, key := range []string{"moduleobject", "alerter"} {
+		if properties[key] != nil {
+			m.Errorf("unexpected property %s", key)
+		}
+	}
+
+	AssertEqual(m, properties["interval"].(jsonSchema)["type"], "integer")
+	AssertEqual(m, properties["tags"].(jsonSchema)["items"].(jsonSchema)["type"], "string")
+
+	// the embedded threshold is flattened
+	thresholds := properties["thresholds"].(jsonSchema)["properties"].(jsonSchema)
+	AssertEqual(m, thresholds["critical"].(jsonSchema)["type"], "number")
+
+	// every key of the example drivers is known
+	files, _ := filepath.Glob(filepath.Join("examples", "drivers", "*.json"))
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			m.Fatal(err)
+		}
+		driver := map[string]interface{}{}
+		json.Unmarshal(data, &driver)
+		for key := range driver {
+			if properties[strings.ToLower(key)] == nil {
+				m.Errorf("%s: unknown key %s", file, key)
+			}
+		}
+	}
+}
+
+func TestModuleSchema(m *testing.T) {
+	schema := ModuleSchema(modules.HttpModule)
+
+	properties := schema["properties"].(jsonSchema)
+	AssertEqual(m, strings.Join(schema["required"].([]string), ","), "url")
+	AssertEqual(m, properties["timeout"].(jsonSchema)["minimum"], 0.0)
+	AssertEqual(m, properties["method"].(jsonSchema)["default"], "GET")
+	AssertEqual(m, properties["url"].(jsonSchema)["pattern"], "^https?://")
+
+	param := modules.ModuleParameter{Name: "p", Type: "list", Items: &modules.ModuleParameter{Type: "duration"}}
+	items := parameterSchema(param)["items"].(jsonSchema)
+	AssertEqual(m, items["type"], "string")
+	AssertEqual(m, items["pattern"], durationPattern)
+}
+
+func TestGetDriversUnknownKeys(m *testing.T) {
+	dir := createDriversDir(m, map[string]string{
+		"a.yaml": "description: a\nmodule: ping\nintreval: 10\n",
+		"b.json": "{\n  \"description\": \"b\",\n  \"module\": \"ping\",\n  \"thresholds\": {\"critcal\": 1}\n}",
+		"c.yaml": "Description: c\nMODULE: ping\n",
+	})
+
+	drivers, errs := ReadDrivers(testModules(), testConfiguration(dir))
+
+	AssertEqual(m, len(drivers), 1)
+	AssertEqual(m, len(errs), 2)
+	if !strings.Contains(errs[0].Error(), "a.yaml:3: unknown key intreval") {
+		m.Errorf("bad error: %v", errs[0])
+	}
+	if !strings.Contains(errs[1].Error(), "unknown key critcal") {
+		m.Errorf("bad error: %v", errs[1])
+	}
+}
+
+// schemaErrors validates the value against the schema, supporting only the
+// keywords used by DriverSchema
+func schemaErrors(schema map[string]interface{}, value interface{}, path string) []string {
+	errs := []string{}
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, path+": "+fmt.Sprintf(format, args...))
+	}
+
+	if t, found := schema["type"]; found {
+		ok := false
+		switch t {
+		case "object":
+			_, ok = value.(map[string]interface{})
+		case "array":
+			_, ok = value.([]interface{})
+		case "string":
+			_, ok = value.(string)
+		case "boolean":
+			_, ok = value.(bool)
+		case "number":
+			_, ok = value.(float64)
+		case "integer":
+			f, isNumber := value.(float64)
+			ok = isNumber && f == float64(int64(f))
+		}
+		if !ok {
+			fail("%v not %s", value, t)
+			return errs
+		}
+	}
+
+	if enum, found := schema["enum"]; found {
+		ok := false
+		for _, allowed := range enum.([]interface{}) {
+			ok = ok || allowed == value
+		}
+		if !ok {
+			fail("%v not in %v", value, enum)
+		}
+	}
+	if c, found := schema["const"]; found && c != value {
+		fail("%v not %v", value, c)
+	}
+	if pattern, found := schema["pattern"]; found {
+		if str, ok := value.(string); ok && !regexp.MustCompile(pattern.(string)).MatchString(str) {
+			fail("%q doesn't match %s", str, pattern)
+		}
+	}
+	if min, found := schema["minimum"]; found && value.(float64) < min.(float64) {
+		fail("%v below %v", value, min)
+	}
+	if max, found := schema["maximum"]; found && value.(float64) > max.(float64) {
+		fail("%v above %v", value, max)
+	}
+
+	if obj, ok := value.(map[string]interface{}); ok {
+		properties, _ := schema["properties"].(map[string]interface{})
+		patterns, _ := schema["patternProperties"].(map[string]interface{})
+		for key, v := range obj {
+			matched := false
+			if sub, found := properties[key]; found {
+				matched = true
+				errs = append(errs, schemaErrors(sub.(map[string]interface{}), v, path+"."+key)...)
+			}
+			for pattern, sub := range patterns {
+				if regexp.MustCompile(pattern).MatchString(key) {
+					matched = true
+					errs = append(errs, schemaErrors(sub.(map[string]interface{}), v, path+"."+key)...)
+				}
+			}
+			if additional, found := schema["additionalProperties"]; found && !matched {
+				if additional == false {
+					fail("unknown key %s", key)
+				} else if sub, ok := additional.(map[string]interface{}); ok {
+					errs = append(errs, schemaErrors(sub, v, path+"."+key)...)
+				}
+			}
+			if names, found := schema["propertyNames"]; found {
+				errs = append(errs, schemaErrors(names.(map[string]interface{}), key, path+"."+key)...)
+			}
+		}
+		if required, found := schema["required"]; found {
+			for _, key := range required.([]interface{}) {
+				if _, found := obj[key.(string)]; !found {
+					fail("missing %s", key)
+				}
+			}
+		}
+	}
+
+	if list, ok := value.([]interface{}); ok {
+		if items, found := schema["items"]; found {
+			for i, v := range list {
+				errs = append(errs, schemaErrors(items.(map[string]interface{}), v, fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+	}
+
+	if not, found := schema["not"]; found && len(schemaErrors(not.(map[string]interface{}), value, path)) == 0 {
+		fail("matches the negated schema")
+	}
+
+	if all, found := schema["allOf"]; found {
+		for _, sub := range all.([]interface{}) {
+			sub := sub.(map[string]interface{})
+			if cond, found := sub["if"]; found {
+				if len(schemaErrors(cond.(map[string]interface{}), value, path)) == 0 {
+					errs = append(errs, schemaErrors(sub["then"].(map[string]interface{}), value, path)...)
+				}
+				continue
+			}
+			errs = append(errs, schemaErrors(sub, value, path)...)
+		}
+	}
+
+	return errs
+}
+
+// normalize turns the value into what encoding/json decodes
+func normalize(m *testing.T, value interface{}) interface{} {
+	data, err := json.Marshal(value)
+	if err != nil {
+		m.Fatal(err)
+	}
+	var res interface{}
+	json.Unmarshal(data, &res)
+	return res
+}
+
+func TestDriverSchemaAgreesWithAgent(m *testing.T) {
+	fixtures := map[string]string{
+		"valid.yaml":   "description: a\nmodule: ping\nconfiguration: {target: localhost}\n",
+		"case.yaml":    "Description: c\nMODULE: ping\nRunOnStart: true\nconfiguration: {target: localhost}\n",
+		"nested.yaml":  "description: n\nmodule: ping\nThresholds: {Critical: 10}\nconfiguration: {target: localhost}\n",
+		"id.json":      `{"id": "old", "description": "i", "module": "ping", "configuration": {"target": "localhost"}}`,
+		"typo.yaml":    "description: a\nmodule: ping\nintreval: 10\nconfiguration: {target: localhost}\n",
+		"thresh.json":  `{"description": "b", "module": "ping", "thresholds": {"critcal": 1}, "configuration": {"target": "localhost"}}`,
+		"type.yaml":    "description: a\nmodule: ping\ninterval: x\nconfiguration: {target: localhost}\n",
+		"module.yaml":  "description: a\nmodule: unknown\n",
+		"nodesc.yaml":  "module: ping\nconfiguration: {target: localhost}\n",
+		"param.yaml":   "description: a\nmodule: http\nconfiguration: {url: localhost}\n",
+		"missing.yaml": "description: a\nmodule: http\n",
+		"alias.yaml":   "description: a\nmodule: ping\nrun_on_start: true\non_change: {enabled: true}\nconfiguration: {target: localhost}\n",
+		"twice.yaml":   "description: a\nmodule: ping\nrun_on_start: true\nRunOnStart: false\nconfiguration: {target: localhost}\n",
+	}
+	dir := createDriversDir(m, fixtures)
+
+	availableModules := testModules()
+	cfg := testConfiguration(dir)
+	schema := normalize(m, DriverSchema(availableModules)).(map[string]interface{})
+
+	for name := range fixtures {
+		file := filepath.Join(dir, name)
+
+		drivers, err := ReadDriver(file, availableModules, cfg)
+		agentValid := err == nil && len(checkParameters(drivers)) == 0
+
+		doc, err := cfgfile.Read(file)
+		if err != nil {
+			m.Fatal(err)
+		}
+		errs := schemaErrors(schema, normalize(m, doc.Tree), name)
+
+		if agentValid != (len(errs) == 0) {
+			m.Errorf("%s: agent valid %v, schema errors %v", name, agentValid, errs)
+		}
+	}
+}
+
+func TestDriverKeyAliases(m *testing.T) {
+	dir := createDriversDir(m, map[string]string{
+		"alias.yaml": "description: a\nmodule: ping\nrun_on_start: true\non_change: {enabled: true}\n",
+		"twice.yaml": "description: a\nmodule: ping\nrun_on_start: true\nRunOnStart: false\n",
+	})
+
+	drivers, errs := ReadDrivers(testModules(), testConfiguration(dir))
+	AssertEqual(m, len(drivers), 1)
+	AssertEqual(m, drivers[0].RunOnStart, true)
+	AssertEqual(m, drivers[0].OnChange.Enabled, true)
+
+	AssertEqual(m, len(errs), 1)
+	if !strings.Contains(errs[0].Error(), "same key") {
+		m.Errorf("same key error expected, found %v", errs[0])
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/amir/raidman"
+)
+
+// SocketListener accepts events from local clients on a Unix socket, one
+// JSON event per line, and enqueues them as if produced by a driver; each
+// connection is answered with "ok <count>" or "error <reason>". The
+// defaults (host, ttl, tags and attributes) are applied to the events and
+// the local alerts are checked. Only the user running the agent can use
+// the socket.
+type SocketListener struct {
+	path     string
+	listener net.Listener
+	queue    ResQueue
+	defaults EventDefaults
+	alerter  *Alerter
+}
+
+// socketMode are the permissions of the socket
+const socketMode = 0600
+
+func NewSocketListener(path string, queue ResQueue, defaults EventDefaults, alerter *Alerter) (*SocketListener, error) {
+	// a stale socket left by a previous instance, unless still in use
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s in use by another agent", path)
+		}
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Chmod(path, socketMode)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	l := &SocketListener{path, listener, queue, defaults, alerter}
+	go l.accept()
+
+	return l, nil
+}
+
+func (l *SocketListener) Stop() {
+	if l == nil {
+		return
+	}
+	l.listener.Close()
+	os.Remove(l.path)
+}
+
+func (l *SocketListener) accept() {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			return
+		}
+		go l.handle(conn)
+	}
+}
+
+func (l *SocketListener) handle(conn net.Conn) {
+	defer conn.Close()
+
+	events := []*raidman.Event{}
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		ev := &raidman.Event{}
+		err := json.Unmarshal([]byte(line), ev)
+		if err != nil {
+			fmt.Fprintf(conn, "error %v\n", err)
+			return
+		}
+		// riemann can't encode the other metrics, and would stall the sender
+		if normalizeMetric(ev) != nil {
+			fmt.Fprintf(conn, "error bad metric\n")
+			return
+		}
+		events = append(events, ev)
+	}
+
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(conn, "error %v\n", err)
+		return
+	}
+
+	dropped := 0
+
+	for _, ev := range events {
+		if ev.Host == "" {
+			ev.Host = l.defaults.Host
+		}
+		if ev.Ttl == 0 {
+			ev.Ttl = l.defaults.Ttl
+		}
+		if ev.Time == 0 {
+			ev.Time = time.Now().Unix()
+		}
+		ev.Tags = mergeTags(l.defaults.Tags, ev.Tags)
+		ev.Attributes = mergeAttributes(l.defaults.Attributes, ev.Attributes)
+
+		l.alerter.Check(ev)
+
+		select {
+		case l.queue <- ev:
+		default:
+			dropped++
+		}
+	}
+
+	log.Debug("%d events received on %s", len(events), l.path)
+	if dropped > 0 {
+		log.Warning("Queue full, %d events received on %s dropped", dropped, l.path)
+		fmt.Fprintf(conn, "error queue full, %d events dropped\n", dropped)
+		return
+	}
+	fmt.Fprintf(conn, "ok %d\n", len(events))
+}
+
+// sendToSocket hands the events to the agent listening on the socket
+func sendToSocket(path string, events []*raidman.Event) error {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	encoder := json.NewEncoder(conn)
+	for _, ev := range events {
+		err = encoder.Encode(ev)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = conn.(*net.UnixConn).CloseWrite()
+	if err != nil {
+		return err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+
+	reply = strings.TrimSpace(reply)
+	if !strings.HasPrefix(reply, "ok") {
+		return fmt.Errorf("agent replied: %s", reply)
+	}
+
+	return nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/avalente/riemann-agent/cfgfile"
+)
+
+// driverTarget is a document expanded from a driver file with targets
+type driverTarget struct {
+	name string
+	doc  *cfgfile.Document
+	// the inventory pattern, if any
+	inventory string
+}
+
+// lookupKey returns the key of the map matching name regardless of case,
+// like encoding/json does
+func lookupKey(tree map[string]interface{}, name string) (string, bool) {
+	if _, found := tree[name]; found {
+		return name, true
+	}
+	for key := range tree {
+		if strings.EqualFold(key, name) {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// mergeTree returns base with the values of overrides, merging the nested
+// maps
+func mergeTree(base, overrides map[string]interface{}) map[string]interface{} {
+	res := make(map[string]interface{}, len(base))
+	for key, value := range base {
+		res[key] = value
+	}
+
+	for key, value := range overrides {
+		baseKey, found := lookupKey(res, key)
+		if found {
+			baseMap, isMap := res[baseKey].(map[string]interface{})
+			valueMap, isValueMap := value.(map[string]interface{})
+			if isMap && isValueMap {
+				res[baseKey] = mergeTree(baseMap, valueMap)
+				continue
+			}
+			delete(res, baseKey)
+		}
+		res[key] = value
+	}
+
+	return res
+}
+
+// toList accepts also the arrays of tables of TOML
+func toList(value interface{}) ([]interface{}, bool) {
+	switch list := value.(type) {
+	case []interface{}:
+		return list, true
+	case []map[string]interface{}:
+		res := make([]interface{}, len(list))
+		for i, item := range list {
+			res[i] = item
+		}
+		return res, true
+	}
+	return nil, false
+}
+
+// inventoryPattern returns the inventory glob relative to the directory of
+// the driver file
+func inventoryPattern(doc *cfgfile.Document, pattern string) string {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(doc.File), pattern)
+	}
+	return pattern
+}
+
+// inventoryDirs returns the directories to watch for changes to the
+// inventories of the drivers: the ones of the matching files and, if it
+// has no wildcards, the one of the pattern
+func inventoryDirs(drivers []*Driver) []string {
+	res := []string{}
+	found := map[string]bool{}
+
+	add := func(dir string) {
+		if !found[dir] {
+			found[dir] = true
+			res = append(res, dir)
+		}
+	}
+
+	for _, drv := range drivers {
+		if drv.inventory == "" {
+			continue
+		}
+
+		dir := filepath.Dir(drv.inventory)
+		if !strings.ContainsAny(dir, `*?[\`) {
+			add(dir)
+		}
+
+		files, _ := filepath.Glob(drv.inventory)
+		for _, file := range files {
+			add(filepath.Dir(file))
+		}
+	}
+
+	return res
+}
+
+// readInventory returns the targets listed in the files matching the glob
+func readInventory(pattern string) ([]interface{}, error) {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("bad inventory %s: %v", pattern, err)
+	}
+	sort.Strings(files)
+
+	targets := []interface{}{}
+
+	for _, file := range files {
+		inventory, err := cfgfile.Read(file)
+		if err == nil {
+			err = inventory.Interpolate()
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		items, ok := toList(inventory.Tree)
+		if !ok {
+			return nil, &cfgfile.FileError{File: file, Err: fmt.Errorf("list of targets expected")}
+		}
+		targets = append(targets, items...)
+	}
+
+	return targets, nil
+}
+
+// expandTargets turns a driver file declaring targets (listed in the file
+// or in the inventory files) into a document per target: each target is a
+// name, or a map with a name and the options overriding the ones in the
+// file. Unless overridden, the service of each target is the one of the
+// file followed by the target name. Files without targets are returned as
+// they are, with an empty name.
+func expandTargets(doc *cfgfile.Document) ([]driverTarget, error) {
+	tree, ok := doc.Tree.(map[string]interface{})
+	if !ok {
+		return []driverTarget{{"", doc, ""}}, nil
+	}
+
+	targetsKey, hasTargets := lookupKey(tree, "targets")
+	inventoryKey, hasInventory := lookupKey(tree, "inventory")
+	if !hasTargets && !hasInventory {
+		return []driverTarget{{"", doc, ""}}, nil
+	}
+
+	items := []interface{}{}
+
+	if hasTargets {
+		list, ok := toList(tree[targetsKey])
+		if !ok {
+			return nil, doc.Errorf([]string{"targets"}, "list of targets expected")
+		}
+		items = append(items, list...)
+	}
+
+	inventory := ""
+	if hasInventory {
+		pattern, ok := tree[inventoryKey].(string)
+		if !ok {
+			return nil, doc.Errorf([]string{"inventory"}, "file pattern expected")
+		}
+		inventory = inventoryPattern(doc, pattern)
+		targets, err := readInventory(inventory)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, targets...)
+	}
+
+	if len(items) == 0 {
+		return nil, doc.Errorf([]string{"targets"}, "no targets")
+	}
+
+	base := map[string]interface{}{}
+	for key, value := range tree {
+		if key != targetsKey && key != inventoryKey {
+			base[key] = value
+		}
+	}
+
+	service := ""
+	if key, found := lookupKey(base, "service"); found {
+		service, _ = base[key].(string)
+	}
+	if key, found := lookupKey(base, "description"); found && service == "" {
+		service, _ = base[key].(string)
+	}
+
+	res := []driverTarget{}
+	names := map[string]bool{}
+
+	for i, item := range items {
+		overrides := map[string]interface{}{}
+
+		switch value := item.(type) {
+		case string:
+			overrides["name"] = value
+		case map[string]interface{}:
+			overrides = value
+		default:
+			return nil, doc.Errorf([]string{"targets"}, "target %d: name or map expected", i+1)
+		}
+
+		nameKey, _ := lookupKey(overrides, "name")
+		name, _ := overrides[nameKey].(string)
+		if name == "" {
+			return nil, doc.Errorf([]string{"targets"}, "target %d: missing name", i+1)
+		}
+		if names[name] {
+			return nil, doc.Errorf([]string{"targets"}, "duplicated target %s", name)
+		}
+		names[name] = true
+
+		targetOverrides := map[string]interface{}{}
+		for key, value := range overrides {
+			if key != nameKey {
+				targetOverrides[key] = value
+			}
+		}
+		if _, found := lookupKey(targetOverrides, "service"); !found {
+			targetOverrides["service"] = strings.TrimSpace(service + " " + name)
+		}
+
+		targetDoc := *doc
+		targetDoc.Tree = mergeTree(base, targetOverrides)
+		res = append(res, driverTarget{name, &targetDoc, inventory})
+	}
+
+	return res, nil
+}
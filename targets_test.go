@@ -0,0 +1,187 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func driversById(drivers []*Driver) map[string]*Driver {
+	res := map[string]*Driver{}
+	for _, drv := range drivers {
+		res[filepath.Base(drv.Id)] = drv
+	}
+	return res
+}
+
+func sortedIds(drivers []*Driver) string {
+	ids := strings.Split(driverIds(drivers), ",")
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+func TestTargets(m *testing.T) {
+	dir := createDriversDir(m, map[string]string{
+		"web.yaml": `description: web
+module: ping
+interval: 30
+configuration:
+  target: localhost
+  count: 1
+targets:
+  - alpha
+  - name: beta
+    interval: 10
+    configuration:
+      target: beta.local
+  - name: gamma
+    service: gamma ping
+`,
+		"single.yaml": "description: single\nmodule: ping\n",
+	})
+
+	drivers, errs := ReadDrivers(testModules(), testConfiguration(dir))
+	AssertEqual(m, len(errs), 0)
+	AssertEqual(m, sortedIds(drivers), "single.yaml,web.yaml#alpha,web.yaml#beta,web.yaml#gamma")
+
+	byId := driversById(drivers)
+
+	alpha := byId["web.yaml#alpha"]
+	AssertEqual(m, alpha.Service, "web alpha")
+	AssertEqual(m, alpha.Interval, 30)
+	AssertEqual(m, alpha.Configuration["target"], "localhost")
+	AssertEqual(m, len(alpha.Targets), 0)
+
+	beta := byId["web.yaml#beta"]
+	AssertEqual(m, beta.Service, "web beta")
+	AssertEqual(m, beta.Interval, 10)
+	AssertEqual(m, beta.Configuration["target"], "beta.local")
+	AssertEqual(m, beta.Configuration["count"], 1.0)
+
+	AssertEqual(m, byId["web.yaml#gamma"].Service, "gamma ping")
+	AssertEqual(m, byId["single.yaml"].Service, "single")
+}
+
+func TestTargetsInventory(m *testing.T) {
+	dir := createDriversDir(m, map[string]string{
+		"hosts.toml": "description = \"hosts\"\nmodule = \"ping\"\nservice = \"ping\"\ninventory = \"inventory/*.json\"\n",
+	})
+	inventory := filepath.Join(dir, "inventory")
+	err := os.Mkdir(inventory, 0755)
+	if err != nil {
+		m.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"a.json": `["db1", {"name": "db2", "configuration": {"target": "10.0.0.2"}}]`,
+		"b.json": `["web1"]`,
+	} {
+		err = ioutil.WriteFile(filepath.Join(inventory, name), []byte(content), 0644)
+		if err != nil {
+			m.Fatal(err)
+		}
+	}
+
+	drivers, errs := ReadDrivers(testModules(), testConfiguration(dir))
+	AssertEqual(m, len(errs), 0)
+	AssertEqual(m, sortedIds(drivers), "hosts.toml#db1,hosts.toml#db2,hosts.toml#web1")
+
+	byId := driversById(drivers)
+	AssertEqual(m, byId["hosts.toml#db1"].Service, "ping db1")
+	AssertEqual(m, byId["hosts.toml#db2"].Configuration["target"], "10.0.0.2")
+}
+
+func TestTargetsErrors(m *testing.T) {
+	dir := createDriversDir(m, map[string]string{
+		"dup.yaml":     "description: dup\nmodule: ping\ntargets: [a, a]\n",
+		"noname.yaml":  "description: noname\nmodule: ping\ntargets: [{interval: 5}]\n",
+		"bad.yaml":     "description: bad\nmodule: ping\ntargets: a\n",
+		"empty.yaml":   "description: empty\nmodule: ping\ninventory: missing/*.json\n",
+		"target.yaml":  "description: target\nmodule: ping\ntargets: [{name: a, interval: x}]\n",
+		"unknown.yaml": "description: unknown\nmodule: ping\ntargets: [{name: a, foo: 1}]\n",
+	})
+
+	drivers, errs := ReadDrivers(testModules(), testConfiguration(dir))
+	AssertEqual(m, len(drivers), 0)
+	AssertEqual(m, len(errs), 6)
+
+	messages := []string{}
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	all := strings.Join(messages, "\n")
+
+	for _, expected := range []string{"duplicated target a", "target 1: missing name", "list of targets expected",
+		"no targets", "target a:", "unknown key foo"} {
+		if !strings.Contains(all, expected) {
+			m.Errorf("missing error %q in:\n%s", expected, all)
+		}
+	}
+}
+
+func TestTargetsDiff(m *testing.T) {
+	dir := createDriversDir(m, map[string]string{
+		"web.yaml": "description: web\nmodule: ping\ntargets: [a, b, c]\n",
+	})
+	cfg := testConfiguration(dir)
+
+	running := GetDrivers(testModules(), cfg)
+	AssertEqual(m, len(running), 3)
+
+	err := ioutil.WriteFile(filepath.Join(dir, "web.yaml"),
+		[]byte("description: web\nmodule: ping\ntargets: [a, {name: b, interval: 10}, d]\n"), 0644)
+	if err != nil {
+		m.Fatal(err)
+	}
+
+	keep, stop, start := diffDrivers(running, GetDrivers(testModules(), cfg))
+	AssertEqual(m, sortedIds(keep), "web.yaml#a")
+	AssertEqual(m, sortedIds(stop), "web.yaml#b,web.yaml#c")
+	AssertEqual(m, sortedIds(start), "web.yaml#b,web.yaml#d")
+}
+
+func TestTargetsInventoryAmongDrivers(m *testing.T) {
+	dir := createDriversDir(m, map[string]string{
+		"hosts.yaml":     "description: hosts\nmodule: ping\ninventory: hosts-*.json\n",
+		"hosts-all.json": `["db1", "db2"]`,
+	})
+
+	drivers, errs := ReadDrivers(testModules(), testConfiguration(dir))
+	AssertEqual(m, len(errs), 0)
+	AssertEqual(m, sortedIds(drivers), "hosts.yaml#db1,hosts.yaml#db2")
+	AssertEqual(m, strings.Join(inventoryDirs(drivers), ","), dir)
+}
+
+func TestTargetsInventoryWatched(m *testing.T) {
+	dir := createDriversDir(m, map[string]string{
+		"hosts.yaml": "description: hosts\nmodule: ping\ninventory: inventory/*.json\n",
+	})
+	inventory := filepath.Join(dir, "inventory")
+	err := os.Mkdir(inventory, 0755)
+	if err != nil {
+		m.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(inventory, "a.json"), []byte(`["db1"]`), 0644)
+	if err != nil {
+		m.Fatal(err)
+	}
+
+	cfg := testConfiguration(dir)
+	drivers := GetDrivers(testModules(), cfg)
+	AssertEqual(m, strings.Join(inventoryDirs(drivers), ","), inventory)
+
+	w, err := NewWatcher(cfg, filepath.Join(dir, "config.json"), inventoryDirs(drivers), 50*time.Millisecond)
+	if err != nil {
+		m.Fatal(err)
+	}
+	defer w.Stop()
+
+	err = ioutil.WriteFile(filepath.Join(inventory, "a.json"), []byte(`["db1", "db2"]`), 0644)
+	if err != nil {
+		m.Fatal(err)
+	}
+	expectReload(m, w, true)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/amir/raidman"
+
+	"github.com/avalente/riemann-agent/modules"
+)
+
+// templateData is the data available to the driver templates
+type templateData struct {
+	Driver     *Driver
+	Params     modules.ModuleParamList
+	Event      *raidman.Event
+	Attributes map[string]string
+	Hostname   string
+}
+
+var hostname struct {
+	sync.RWMutex
+	value string
+}
+
+// setAgentHostname sets the name of the agent, the host configured in the
+// event defaults
+func setAgentHostname(name string) {
+	hostname.Lock()
+	defer hostname.Unlock()
+	hostname.value = name
+}
+
+// agentHostname returns the name of the agent: the configured default
+// host, or the machine host name before any configuration is read
+func agentHostname() string {
+	hostname.RLock()
+	name := hostname.value
+	hostname.RUnlock()
+
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	return name
+}
+
+var templateFuncs = template.FuncMap{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"trim":  strings.TrimSpace,
+	"float": toFloat,
+	"replace": func(old, new, s string) string {
+		return strings.Replace(s, old, new, -1)
+	},
+}
+
+// compileTemplate parses the given value as a template; it returns nil
+// if the value doesn't contain any action, so that it can be used as is
+func compileTemplate(name string, value string) (*template.Template, error) {
+	if !strings.Contains(value, "{{") {
+		return nil, nil
+	}
+
+	return template.New(name).Option("missingkey=zero").Funcs(templateFuncs).Parse(value)
+}
+
+// checkTemplate executes the template against a sample of the data
+// available at run time, catching references to unknown fields
+func checkTemplate(tmpl *template.Template, drv *Driver) error {
+	data := templateData{
+		Driver:     drv,
+		Params:     modules.ModuleParamList(drv.Configuration),
+		Event:      &raidman.Event{},
+		Attributes: map[string]string{},
+		Hostname:   agentHostname(),
+	}
+	_, err := renderTemplate(tmpl, &data)
+	return err
+}
+
+func renderTemplate(tmpl *template.Template, data *templateData) (string, error) {
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// toFloat converts a metric (or any number) to float64, so that it can be
+// compared in templates regardless of the type set by the module
+func toFloat(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case nil:
+		return 0, nil
+	case int:
+		return float64(v), nil
+	case int32:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case float32:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	}
+	return 0, fmt.Errorf("not a number: %v", value)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/amir/raidman"
+)
+
+const (
+	ThresholdAbove = "above"
+	ThresholdBelow = "below"
+)
+
+// Threshold maps the metric of an event to ok/warning/critical states
+type Threshold struct {
+	Warning   *float64
+	Critical  *float64
+	Direction string
+}
+
+// Thresholds are the driver thresholds, with optional overrides for the
+// services matching a glob pattern
+type Thresholds struct {
+	Threshold
+	Services map[string]Threshold
+	// the service patterns, the most specific first (set by Validate)
+	patterns []string
+}
+
+func (t *Threshold) validate() error {
+	switch t.Direction {
+	case "", ThresholdAbove, ThresholdBelow:
+	default:
+		return fmt.Errorf("bad threshold direction: %s", t.Direction)
+	}
+
+	if t.Warning != nil && t.Critical != nil {
+		if t.Direction == ThresholdBelow && *t.Warning < *t.Critical {
+			return fmt.Errorf("warning threshold (%v) below critical one (%v)", *t.Warning, *t.Critical)
+		}
+		if t.Direction != ThresholdBelow && *t.Warning > *t.Critical {
+			return fmt.Errorf("warning threshold (%v) above critical one (%v)", *t.Warning, *t.Critical)
+		}
+	}
+
+	return nil
+}
+
+// override returns the threshold with the values set in the override
+func (t Threshold) override(override Threshold) Threshold {
+	if override.Warning != nil {
+		t.Warning = override.Warning
+	}
+	if override.Critical != nil {
+		t.Critical = override.Critical
+	}
+	if override.Direction != "" {
+		t.Direction = override.Direction
+	}
+	return t
+}
+
+// Validate checks the thresholds and the service patterns, each override
+// merged with the driver threshold
+func (t *Thresholds) Validate() error {
+	err := t.Threshold.validate()
+	if err != nil {
+		return err
+	}
+
+	t.patterns = make([]string, 0, len(t.Services))
+
+	for pattern, override := range t.Services {
+		_, err := CompileGlob(pattern)
+		if err != nil {
+			return fmt.Errorf("bad service pattern: %v", err)
+		}
+
+		threshold := t.Threshold.override(override)
+		err = threshold.validate()
+		if err != nil {
+			return fmt.Errorf("service %s: %v", pattern, err)
+		}
+
+		t.patterns = append(t.patterns, pattern)
+	}
+
+	// the most specific (the longest) first
+	sort.Slice(t.patterns, func(i, j int) bool {
+		if len(t.patterns[i]) != len(t.patterns[j]) {
+			return len(t.patterns[i]) > len(t.patterns[j])
+		}
+		return t.patterns[i] < t.patterns[j]
+	})
+
+	return nil
+}
+
+// forService returns the threshold for the given service: the driver one,
+// overridden by the most specific matching pattern
+func (t *Thresholds) forService(service string) Threshold {
+	for _, pattern := range t.patterns {
+		if matchGlob(pattern, service) {
+			return t.Threshold.override(t.Services[pattern])
+		}
+	}
+
+	return t.Threshold
+}
+
+func (t *Threshold) exceeded(limit *float64, value float64) bool {
+	if limit == nil {
+		return false
+	}
+	if t.Direction == ThresholdBelow {
+		return value < *limit
+	}
+	return value > *limit
+}
+
+// metricValue returns the metric of the event as float64
+func metricValue(ev *raidman.Event) (float64, bool) {
+	if ev.Metric == nil {
+		return 0, false
+	}
+	value, err := toFloat(ev.Metric)
+	return value, err == nil
+}
+
+// Apply sets the state of the event according to its metric. Only events
+// with a metric and a "healthy" state (none, "ok" or "success") are
+// affected, so that failures reported by the module are kept.
+func (t *Thresholds) Apply(ev *raidman.Event) {
+	if ev.State != "" && ev.State != "ok" && ev.State != "success" {
+		return
+	}
+
+	value, ok := metricValue(ev)
+	if !ok {
+		return
+	}
+
+	threshold := t.forService(ev.Service)
+	if threshold.Warning == nil && threshold.Critical == nil {
+		return
+	}
+
+	switch {
+	case threshold.exceeded(threshold.Critical, value):
+		ev.State = "critical"
+	case threshold.exceeded(threshold.Warning, value):
+		ev.State = "warning"
+	default:
+		ev.State = "ok"
+	}
+
+	if ev.Attributes == nil {
+		ev.Attributes = map[string]string{}
+	}
+	if threshold.Warning != nil {
+		ev.Attributes["threshold_warning"] = strconv.FormatFloat(*threshold.Warning, 'g', -1, 64)
+	}
+	if threshold.Critical != nil {
+		ev.Attributes["threshold_critical"] = strconv.FormatFloat(*threshold.Critical, 'g', -1, 64)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/amir/raidman"
+)
+
+func TestThresholdsFromDriverFile(m *testing.T) {
+	dir := createDriversDir(m, map[string]string{
+		"a.yaml": `description: a
+module: ping
+thresholds:
+  warning: 0.5
+  critical: 1
+  services:
+    "disk *":
+      warning: 20
+      critical: 10
+      direction: below
+`,
+	})
+
+	drivers := GetDrivers(testModules(), testConfiguration(dir))
+	if len(drivers) != 1 {
+		m.Fatalf("1 driver expected, %d found", len(drivers))
+	}
+
+	t := drivers[0].Thresholds
+
+	ev := raidman.Event{Service: "latency", Metric: 0.7}
+	t.Apply(&ev)
+	AssertEqual(m, ev.State, "warning")
+	AssertEqual(m, ev.Attributes["threshold_warning"], "0.5")
+	AssertEqual(m, ev.Attributes["threshold_critical"], "1")
+
+	ev = raidman.Event{Service: "latency", Metric: 2, State: "success"}
+	t.Apply(&ev)
+	AssertEqual(m, ev.State, "critical")
+
+	ev = raidman.Event{Service: "latency", Metric: 0.1}
+	t.Apply(&ev)
+	AssertEqual(m, ev.State, "ok")
+
+	ev = raidman.Event{Service: "disk /", Metric: 15}
+	t.Apply(&ev)
+	AssertEqual(m, ev.State, "warning")
+
+	ev = raidman.Event{Service: "disk /", Metric: 5}
+	t.Apply(&ev)
+	AssertEqual(m, ev.State, "critical")
+}
+
+func TestThresholdsKeepModuleFailures(m *testing.T) {
+	warning := 1.0
+	t := Thresholds{Threshold: Threshold{Warning: &warning}}
+
+	ev := raidman.Event{Metric: 0.1, State: "failure"}
+	t.Apply(&ev)
+	AssertEqual(m, ev.State, "failure")
+
+	ev = raidman.Event{State: "ok"}
+	t.Apply(&ev)
+	AssertEqual(m, ev.State, "ok")
+	AssertEqual(m, len(ev.Attributes), 0)
+}
+
+func TestThresholdsValidation(m *testing.T) {
+	low, high := 1.0, 2.0
+
+	bad := []Thresholds{
+		{Threshold: Threshold{Direction: "sideways"}},
+		{Threshold: Threshold{Warning: &high, Critical: &low}},
+		{Threshold: Threshold{Warning: &low, Critical: &high, Direction: ThresholdBelow}},
+		{Services: map[string]Threshold{"[": {}}},
+		{Threshold: Threshold{Warning: &low}, Services: map[string]Threshold{"a*": {Critical: &low, Warning: &high}}},
+		// a pattern not matching itself
+		{Threshold: Threshold{Warning: &low}, Services: map[string]Threshold{"disk[ab]": {Critical: &low, Warning: &high}}},
+		// the override is checked, not the one of another pattern
+		{Services: map[string]Threshold{"disk[ab]": {Critical: &low, Warning: &high}, "disk*": {Warning: &low}}},
+	}
+
+	for i, t := range bad {
+		if t.Validate() == nil {
+			m.Errorf("error expected for thresholds %d", i)
+		}
+	}
+
+	good := Thresholds{Threshold: Threshold{Warning: &low, Critical: &high},
+		Services: map[string]Threshold{"disk[ab]": {Direction: ThresholdBelow, Warning: &high, Critical: &low}}}
+	if err := good.Validate(); err != nil {
+		m.Errorf("no error expected, found %v", err)
+	}
+
+	ev := raidman.Event{Service: "diska", Metric: 0.5}
+	good.Apply(&ev)
+	AssertEqual(m, ev.State, "critical")
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Watcher signals on Reload when the configuration file, the drivers,
+// their inventories or the custom modules change, once no further change
+// happened for the debounce period
+type Watcher struct {
+	watcher    *fsnotify.Watcher
+	configFile string
+	// the watched directories, besides the one of the config file
+	dirs     map[string]bool
+	debounce time.Duration
+	reload   chan bool
+	done     chan bool
+}
+
+func NewWatcher(cfg *Configuration, configFile string, inventoryDirs []string, debounce time.Duration) (*Watcher, error) {
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	configFile, err = filepath.Abs(configFile)
+	if err != nil {
+		fw.Close()
+		return nil, err
+	}
+
+	w := &Watcher{fw, configFile, map[string]bool{}, debounce, make(chan bool, 1), make(chan bool)}
+
+	dirs := append([]string{cfg.DriversDirectory}, inventoryDirs...)
+
+	if cfg.ModulesDirectory != "" {
+		dirs = append(dirs, cfg.ModulesDirectory)
+
+		// each custom module lives in its own directory
+		entries, err := ioutil.ReadDir(cfg.ModulesDirectory)
+		if err == nil {
+			for _, entry := range entries {
+				if entry.IsDir() {
+					dirs = append(dirs, filepath.Join(cfg.ModulesDirectory, entry.Name()))
+				}
+			}
+		}
+	}
+
+	for _, dir := range dirs {
+		dir, err = filepath.Abs(dir)
+		if err == nil {
+			w.dirs[dir] = true
+		}
+	}
+
+	// editors often replace the files, so the config file is watched
+	// through its directory
+	for _, dir := range append(dirs, filepath.Dir(configFile)) {
+		err = fw.Add(dir)
+		if err != nil && !os.IsNotExist(err) {
+			fw.Close()
+			return nil, err
+		}
+	}
+
+	go w.loop()
+
+	return w, nil
+}
+
+// Reload returns the channel signalling the changes; it never fires on a
+// nil watcher
+func (w *Watcher) Reload() <-chan bool {
+	if w == nil {
+		return nil
+	}
+	return w.reload
+}
+
+func (w *Watcher) Stop() {
+	if w == nil {
+		return
+	}
+	w.done <- true
+	w.watcher.Close()
+}
+
+// relevant filters out the changes to the other files in the directory of
+// the configuration file and the bare permission changes
+func (w *Watcher) relevant(ev fsnotify.Event) bool {
+	if ev.Op == fsnotify.Chmod {
+		return false
+	}
+
+	name, err := filepath.Abs(ev.Name)
+	if err != nil {
+		return false
+	}
+
+	return name == w.configFile || w.dirs[filepath.Dir(name)]
+}
+
+func (w *Watcher) loop() {
+	var timeout <-chan time.Time
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case ev, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if w.relevant(ev) {
+				log.Debug("Change detected: %v", ev)
+				timeout = time.After(w.debounce)
+			}
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Error("Watcher error: %v", err)
+		case <-timeout:
+			timeout = nil
+			select {
+			case w.reload <- true:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestWatcher(m *testing.T) (*Watcher, string, string) {
+	dir, err := ioutil.TempDir(ctx.dir, "watch")
+	if err != nil {
+		m.Fatal(err)
+	}
+
+	cfg := NewConfiguration()
+	cfg.DriversDirectory = filepath.Join(dir, "drivers")
+	cfg.ModulesDirectory = filepath.Join(dir, "modules")
+	os.Mkdir(cfg.DriversDirectory, 0755)
+
+	configFile := filepath.Join(dir, "config.json")
+
+	w, err := NewWatcher(cfg, configFile, []string{filepath.Join(dir, "inventory")}, 50*time.Millisecond)
+	if err != nil {
+		m.Fatal(err)
+	}
+
+	return w, dir, configFile
+}
+
+func expectReload(m *testing.T, w *Watcher, expected bool) {
+	select {
+	case <-w.Reload():
+		if !expected {
+			m.Fatal("no reload expected")
+		}
+	case <-time.After(300 * time.Millisecond):
+		if expected {
+			m.Fatal("reload expected")
+		}
+	}
+}
+
+func TestWatcherDrivers(m *testing.T) {
+	w, dir, _ := newTestWatcher(m)
+	defer w.Stop()
+
+	for _, name := range []string{"a.yaml", "b.yaml", "a.yaml"} {
+		ioutil.WriteFile(filepath.Join(dir, "drivers", name), []byte("description: a\n"), 0644)
+	}
+
+	// debounced
+	expectReload(m, w, true)
+	expectReload(m, w, false)
+}
+
+func TestWatcherConfigFile(m *testing.T) {
+	w, dir, configFile := newTestWatcher(m)
+	defer w.Stop()
+
+	ioutil.WriteFile(filepath.Join(dir, "other.json"), []byte("{}"), 0644)
+	expectReload(m, w, false)
+
+	ioutil.WriteFile(configFile, []byte("{}"), 0644)
+	expectReload(m, w, true)
+}
+
+func TestWatcherNil(m *testing.T) {
+	var w *Watcher
+	w.Stop()
+
+	select {
+	case <-w.Reload():
+		m.Fatal("no reload expected")
+	default:
+	}
+}